@@ -0,0 +1,231 @@
+package gop
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Protection for the /gop admin endpoints. They can be moved to their own listener with
+// [gop] admin_listen_addr, restricted to admin_allow_cidrs, and made to need a bearer
+// token (admin_token) or basic auth (admin_user/admin_password). Every call which could
+// change something (anything but GET and HEAD) is written to the admin audit log.
+
+const adminListener = "admin"
+
+const (
+	maxAdminBodyBytes = 1 << 20 // whatever max_body_bytes says
+	maxAuditBodyBytes = 4096
+)
+
+func (a *App) adminListenAddr() string {
+	addr, _ := a.Cfg.Get("gop", "admin_listen_addr", "")
+	return addr
+}
+
+// Where the /gop handlers go: the admin listener's router if we have one, otherwise the app's
+func (a *App) adminRouter() *Router {
+	if a.adminListenAddr() != "" {
+		return a.ListenerRouter(adminListener, a.adminAuth)
+	}
+	return &Router{
+		app:           a,
+		middleware:    []Middleware{a.adminAuth},
+		GorillaRouter: a.GorillaRouter,
+	}
+}
+
+// Is the client in admin_allow_cidrs? Unix socket clients always are - the socket's
+// file permissions guard it. We check our peer, or the client behind trusted_proxies,
+// but never the use_xf_headers address, which any client can set.
+func (a *App) adminAllowedIP(g *Req) bool {
+	cidrs, found := a.Cfg.GetList("gop", "admin_allow_cidrs", nil)
+	if !found {
+		return true
+	}
+	if g.R.RemoteAddr == "" || g.R.RemoteAddr == "@" {
+		return true
+	}
+	clientAddr := g.R.RemoteAddr
+	if len(a.trustedProxies()) > 0 {
+		clientAddr = g.RealRemoteIP
+	}
+	ip := net.ParseIP(stripPort(clientAddr))
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			a.Errorf("Bad admin_allow_cidrs entry [%s]: %s", cidr, err.Error())
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Who the client authenticated as. ok is false if auth is configured and they didn't
+// pass it.
+func (a *App) adminUser(g *Req) (user string, ok bool) {
+	token, _ := a.Cfg.Get("gop", "admin_token", "")
+	adminUser, _ := a.Cfg.Get("gop", "admin_user", "")
+	adminPassword, _ := a.Cfg.Get("gop", "admin_password", "")
+	if token == "" && adminUser == "" {
+		return peerName(g.Peer), true
+	}
+	auth := g.R.Header.Get("Authorization")
+	if token != "" && strings.HasPrefix(auth, "Bearer ") && secureEqual(strings.TrimPrefix(auth, "Bearer "), token) {
+		return "token", true
+	}
+	if adminUser != "" {
+		user, password, hasBasic := g.R.BasicAuth()
+		if hasBasic && secureEqual(user, adminUser) && secureEqual(password, adminPassword) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func (a *App) adminAuth(next HandlerFunc) HandlerFunc {
+	return func(g *Req) error {
+		enabled := a.configBool("gop", "enable_gop_urls", false)
+		if !enabled {
+			return NotFound("Not enabled")
+		}
+		if !a.adminAllowedIP(g) {
+			g.Errorf("Admin request from %s refused - not in admin_allow_cidrs", g.RealRemoteIP)
+			g.app.Stats.Inc("admin.refused", 1)
+			return HTTPError{Code: http.StatusForbidden, Body: "Forbidden", ErrorCode: "forbidden"}
+		}
+		user, ok := a.adminUser(g)
+		if !ok {
+			g.app.Stats.Inc("admin.unauthorized", 1)
+			challenge := `Bearer realm="gop"`
+			if adminUser, _ := a.Cfg.Get("gop", "admin_user", ""); adminUser != "" {
+				challenge = `Basic realm="gop"`
+			}
+			return HTTPError{Code: http.StatusUnauthorized, Body: "Unauthorized", ErrorCode: "unauthorized"}.WithHeader("WWW-Authenticate", challenge)
+		}
+
+		if g.R.Method == "GET" || g.R.Method == "HEAD" {
+			return next(g)
+		}
+		// Keep a copy of the body for the audit log, and put it back for the handler
+		var body []byte
+		if g.R.Body != nil {
+			var readErr error
+			body, readErr = ioutil.ReadAll(http.MaxBytesReader(g.W, g.R.Body, maxAdminBodyBytes))
+			if err := g.bodyError(readErr); err != nil {
+				a.audit(g, user, body, err)
+				return err
+			}
+			g.R.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		err := next(g)
+		a.audit(g, user, body, err)
+		return err
+	}
+}
+
+type auditEntry struct {
+	Time      string `json:"time"`
+	RequestID string `json:"request_id"`
+	RemoteIP  string `json:"remote_ip"`
+	User      string `json:"user,omitempty"`
+	Method    string `json:"method"`
+	Url       string `json:"url"`
+	Form      string `json:"form,omitempty"`
+	Body      string `json:"body,omitempty"`
+	Code      int    `json:"code"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Config paths and form fields whose values shouldn't be logged
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"password", "token", "secret", "key_file"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactedForm(form url.Values) string {
+	redacted := make(url.Values, len(form))
+	for k, v := range form {
+		if isSecret(k) {
+			v = []string{"[redacted]"}
+		}
+		redacted[k] = v
+	}
+	return redacted.Encode()
+}
+
+// One JSON line per mutating admin call
+func (a *App) audit(g *Req, user string, body []byte, err error) {
+	entry := auditEntry{
+		Time:      time.Now().Format(time.RFC3339),
+		RequestID: g.requestID,
+		RemoteIP:  g.RealRemoteIP,
+		User:      user,
+		Method:    g.R.Method,
+		Url:       g.R.URL.String(),
+		Form:      redactedForm(g.R.PostForm),
+		Body:      string(body),
+		Code:      g.W.code,
+	}
+	if len(body) > maxAuditBodyBytes {
+		entry.Body = string(body[:maxAuditBodyBytes]) + "...[truncated]"
+	}
+	if isSecret(g.R.URL.Path) {
+		// A form-encoded body is in both
+		entry.Body = "[redacted]"
+		if entry.Form != "" {
+			entry.Form = "[redacted]"
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		if httpErr, ok := err.(HTTPError); ok {
+			entry.Code = httpErr.Code
+		} else {
+			entry.Code = http.StatusInternalServerError
+		}
+	}
+	line, _ := json.Marshal(entry)
+	g.app.Stats.Inc("admin.audited", 1)
+
+	a.auditLock.Lock()
+	defer a.auditLock.Unlock()
+	if a.auditLog == nil {
+		// Opened on first use, so apps which never change anything don't get the file
+		defaultAuditLogFname := a.logDir + "/" + a.AppName + "-admin-audit.log"
+		auditLogFilename, _ := a.Cfg.Get("gop", "admin_audit_log_filename", defaultAuditLogFname)
+		var openErr error
+		a.auditLog, openErr = os.OpenFile(auditLogFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if openErr != nil {
+			a.auditLog = nil
+			a.Errorf("Can't open admin audit log: %s - ADMIN AUDIT: %s", openErr.Error(), line)
+			return
+		}
+	}
+	_, writeErr := a.auditLog.Write(append(line, '\n'))
+	if writeErr != nil {
+		a.Errorf("Failed to write to admin audit log: %s - ADMIN AUDIT: %s", writeErr.Error(), line)
+	}
+}
@@ -0,0 +1,115 @@
+package gop
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func adminRequest(a *App, remoteAddr string, headers map[string]string) int {
+	r, _ := http.NewRequest("GET", "/gop/stack", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return doRequestFrom(a, r).Code
+}
+
+func TestAdminDisabled(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.registerGopHandlers()
+	test.Is(t, adminRequest(a, "127.0.0.1:1000", nil), http.StatusNotFound, "/gop urls off by default")
+}
+
+func TestAdminAllowCIDRs(t *testing.T) {
+	cfg := ConfigMap{"gop": {"enable_gop_urls": "true", "admin_allow_cidrs": "127.0.0.0/8", "use_xf_headers": "true"}}
+	a := newTestApp(t, cfg)
+	a.registerGopHandlers()
+	spoofed := map[string]string{"X-Forwarded-For": "127.0.0.1"}
+
+	test.Is(t, adminRequest(a, "127.0.0.1:1000", nil), http.StatusOK, "allowed client")
+	test.Is(t, adminRequest(a, "192.0.2.1:1000", nil), http.StatusForbidden, "other client refused")
+	test.Is(t, adminRequest(a, "192.0.2.1:1000", spoofed), http.StatusForbidden, "X-Forwarded-For not believed")
+	test.Is(t, adminRequest(a, "@", nil), http.StatusOK, "unix socket client allowed")
+
+	waitRetired(a)
+	a.Cfg.TransientOverride("gop", "trusted_proxies", "192.0.2.1")
+	test.Is(t, adminRequest(a, "192.0.2.1:1000", spoofed), http.StatusOK, "client behind a trusted proxy allowed")
+	test.Is(t, adminRequest(a, "192.0.2.2:1000", spoofed), http.StatusForbidden, "X-Forwarded-For from an untrusted peer not believed")
+
+	waitRetired(a)
+	a.Cfg.TransientOverride("gop", "trusted_proxies", "192.0.2.2")
+	test.Is(t, adminRequest(a, "192.0.2.1:1000", spoofed), http.StatusForbidden, "proxy no longer trusted once the config changes")
+	test.Is(t, adminRequest(a, "192.0.2.2:1000", spoofed), http.StatusOK, "newly trusted proxy")
+}
+
+func TestAdminAuth(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"enable_gop_urls": "true", "admin_token": "sekrit", "admin_user": "ops", "admin_password": "pw"}})
+	a.registerGopHandlers()
+
+	test.Is(t, adminRequest(a, "127.0.0.1:1000", nil), http.StatusUnauthorized, "no credentials")
+	test.Is(t, adminRequest(a, "127.0.0.1:1000", map[string]string{"Authorization": "Bearer wrong"}), http.StatusUnauthorized, "wrong token")
+	test.Is(t, adminRequest(a, "127.0.0.1:1000", map[string]string{"Authorization": "Bearer sekrit"}), http.StatusOK, "token")
+
+	r, _ := http.NewRequest("GET", "/gop/stack", nil)
+	r.SetBasicAuth("ops", "pw")
+	test.Is(t, doRequestFrom(a, r).Code, http.StatusOK, "basic auth")
+	r.SetBasicAuth("ops", "nope")
+	w := doRequestFrom(a, r)
+	test.Is(t, w.Code, http.StatusUnauthorized, "wrong password")
+	test.Is(t, w.Header().Get("WWW-Authenticate"), `Basic realm="gop"`, "challenge")
+}
+
+func TestAdminAuditRedacts(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"enable_gop_urls": "true"}})
+	a.registerGopHandlers()
+	put := func(url, body, contentType string) {
+		r, _ := http.NewRequest("PUT", url, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.RemoteAddr = "127.0.0.1:1000"
+		doRequestFrom(a, r)
+	}
+	put("/gop/config/gop/admin_password", "hunter2", "application/x-www-form-urlencoded")
+	put("/gop/config/db/api_token", "tok123", "text/plain")
+	put("/gop/config/gop/log_level", "DEBUG", "text/plain")
+	put("/gop/config/gop/x", "api_secret=s3cr3t&name=bob", "application/x-www-form-urlencoded")
+	waitRetired(a)
+
+	audit, err := ioutil.ReadFile(a.logDir + "/app-admin-audit.log")
+	test.OK(t, err == nil, "audit log written")
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	test.Is(t, len(lines), 4, "one line per PUT")
+	for _, secret := range []string{"hunter2", "tok123", "s3cr3t"} {
+		test.OK(t, !strings.Contains(string(audit), secret), "audit log doesn't have "+secret)
+	}
+	test.OK(t, strings.Contains(lines[0], `"form":"[redacted]"`), "form redacted on secret paths")
+	test.OK(t, strings.Contains(lines[2], `"body":"DEBUG"`), "other values logged")
+	test.OK(t, strings.Contains(lines[3], "name=bob"), "other form fields logged")
+}
+
+func TestAdminAuditBodyLimits(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"enable_gop_urls": "true"}})
+	a.registerGopHandlers()
+	put := func(body string) int {
+		r, _ := http.NewRequest("PUT", "/gop/config/gop/x", strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain")
+		r.RemoteAddr = "127.0.0.1:1000"
+		return doRequestFrom(a, r).Code
+	}
+	test.Is(t, put(strings.Repeat("a", maxAuditBodyBytes+100)), http.StatusOK, "big body")
+	test.Is(t, put(strings.Repeat("b", maxAdminBodyBytes+1)), http.StatusRequestEntityTooLarge, "body over the admin limit")
+	waitRetired(a)
+
+	audit, err := ioutil.ReadFile(a.logDir + "/app-admin-audit.log")
+	test.OK(t, err == nil, "audit log written")
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	test.Is(t, len(lines), 2, "both PUTs audited")
+	test.OK(t, strings.Contains(lines[0], `"body":"`+strings.Repeat("a", maxAuditBodyBytes)+`...[truncated]"`), "body truncated in the audit log")
+	test.OK(t, strings.Contains(lines[1], `"code":413`), "refused PUT audited")
+	test.OK(t, len(lines[1]) < 2*maxAuditBodyBytes, "refused body truncated too")
+	value, _ := a.Cfg.Get("gop", "x", "")
+	test.Is(t, len(value), maxAuditBodyBytes+100, "handler got the whole body")
+}
@@ -0,0 +1,413 @@
+package gop
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A single problem found by Req.Bind
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Returned by Req.Bind. Sent to the client as a 400 with a JSON body listing all the field errors.
+type BindError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *BindError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "Invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (e *BindError) Write(w *responseWriter) {
+	body, _ := json.Marshal(struct {
+		Error  string       `json:"error"`
+		Fields []FieldError `json:"fields"`
+	}{"Invalid request", e.Errors})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(append(body, '\n'))
+}
+
+func (e *BindError) HTTPError() HTTPError {
+	return HTTPError{
+		Code:      http.StatusBadRequest,
+		Body:      "Invalid request",
+		ErrorCode: "invalid_request",
+		Details:   e.Errors,
+	}
+}
+
+func (e *BindError) add(field, rule, msg string) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Rule: rule, Message: msg})
+}
+
+// Decode the request into the struct pointed to by dst, then validate it.
+//
+// Values are taken from (later ones winning) a JSON or XML body, the query string and
+// form, and the Gorilla path vars. Query, form and path vars use the `schema` struct
+// tag, as for Decoder. Validation rules are given in a `validate` tag, e.g.
+//
+//	type search struct {
+//		Query string `schema:"q" json:"q" validate:"required,max=100"`
+//		Page  int    `schema:"page" json:"page" validate:"min=1"`
+//		Sort  string `schema:"sort" json:"sort" validate:"enum=asc|desc"`
+//		Tag   string `schema:"tag" json:"tag" validate:"regex=^[a-z]+$"`
+//	}
+//
+// Rules apply to the fields the request gave, whatever their value, so page=0 fails
+// min=1 but leaving page out doesn't. required fails if the field isn't given, or is
+// an empty string, slice or map; an explicit 0 or false is fine. min/max apply to the
+// value of numbers and the length of strings, slices and maps. A regex cannot contain
+// a comma. All problems are reported together in a *BindError, which can be returned
+// straight from the handler.
+func (g *Req) Bind(dst interface{}) error {
+	bindErr := &BindError{}
+	given := &givenFields{}
+
+	err := g.bindBody(dst, given)
+	if tooLarge := g.bodyError(err); tooLarge != nil {
+		return tooLarge
+	}
+	if err != nil {
+		bindErr.add("body", "decode", err.Error())
+		return bindErr
+	}
+
+	values := url.Values{}
+	for k, v := range g.R.Form {
+		values[k] = v
+	}
+	for k, v := range mux.Vars(g.R) {
+		values[k] = []string{v}
+	}
+	for k := range values {
+		// Nested fields are "a.b", with slices of structs "a.0.b"
+		given.add(strings.Split(k, "."))
+	}
+	err = g.Decoder.Decode(dst, values)
+	if err != nil {
+		addDecodeErrors(bindErr, err)
+	}
+
+	validateStruct(bindErr, reflect.ValueOf(dst), "", given)
+	if len(bindErr.Errors) > 0 {
+		return bindErr
+	}
+	return nil
+}
+
+// Decode a JSON or XML body into dst, noting which fields it gave
+func (g *Req) bindBody(dst interface{}, given *givenFields) error {
+	if g.R.Body == nil || g.R.ContentLength == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(g.R.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	isXML := mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+	if !isJSON && !isXML {
+		// Form bodies have already been parsed into R.Form
+		return nil
+	}
+	body, err := io.ReadAll(g.R.Body)
+	if err != nil {
+		return err
+	}
+	if isJSON {
+		err = json.Unmarshal(body, dst)
+		if err == nil {
+			var fields interface{}
+			json.Unmarshal(body, &fields)
+			given.addJSON(fields)
+		}
+		return err
+	}
+	err = xml.Unmarshal(body, dst)
+	if err == nil {
+		given.addXML(body)
+	}
+	return err
+}
+
+// The names of the fields a request gave, as a tree for nested structs
+type givenFields struct {
+	children map[string]*givenFields
+}
+
+// Numeric parts (slice indexes) are skipped, so a slice's fields are checked
+// against what any of its elements gave
+func (f *givenFields) add(path []string) {
+	for _, name := range path {
+		if _, err := strconv.Atoi(name); err == nil {
+			continue
+		}
+		f = f.child(name, true)
+	}
+}
+
+func (f *givenFields) child(name string, create bool) *givenFields {
+	if f == nil {
+		return nil
+	}
+	if child, ok := f.children[strings.ToLower(name)]; ok || !create {
+		return child
+	}
+	if f.children == nil {
+		f.children = make(map[string]*givenFields)
+	}
+	child := &givenFields{}
+	f.children[strings.ToLower(name)] = child
+	return child
+}
+
+func (f *givenFields) addJSON(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			f.child(k, true).addJSON(child)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			f.addJSON(elem)
+		}
+	}
+}
+
+// Elements and attributes below the root element
+func (f *givenFields) addXML(body []byte) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	stack := []*givenFields{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := f
+			if len(stack) > 0 {
+				node = stack[len(stack)-1].child(token.Name.Local, true)
+			}
+			for _, attr := range token.Attr {
+				node.child(attr.Name.Local, true)
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// The field's entry, under any of the names it could have been given by
+func (f *givenFields) field(sf reflect.StructField) *givenFields {
+	for _, tagName := range []string{"schema", "json", "xml"} {
+		name := strings.Split(sf.Tag.Get(tagName), ",")[0]
+		if name != "" && name != "-" {
+			if child := f.child(name, false); child != nil {
+				return child
+			}
+		}
+	}
+	return f.child(sf.Name, false)
+}
+
+func addDecodeErrors(bindErr *BindError, err error) {
+	multiErr, ok := err.(schema.MultiError)
+	if !ok {
+		bindErr.add("", "decode", err.Error())
+		return
+	}
+	keys := make([]string, 0, len(multiErr))
+	for k := range multiErr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// The request may well carry params we don't bind
+		if _, unknown := multiErr[k].(schema.UnknownKeyError); unknown {
+			continue
+		}
+		bindErr.add(k, "decode", multiErr[k].Error())
+	}
+}
+
+var validationRegexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+func validationRegexp(expr string) (*regexp.Regexp, error) {
+	validationRegexps.Lock()
+	defer validationRegexps.Unlock()
+	re, ok := validationRegexps.m[expr]
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	validationRegexps.m[expr] = re
+	return re, nil
+}
+
+// The name a client would know the field by
+func fieldName(f reflect.StructField) string {
+	for _, tagName := range []string{"schema", "json", "xml"} {
+		name := strings.Split(f.Tag.Get(tagName), ",")[0]
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+func validateStruct(bindErr *BindError, v reflect.Value, prefix string, given *givenFields) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := prefix + fieldName(f)
+		fv := v.Field(i)
+		fieldGiven := given.field(f)
+		if rules := f.Tag.Get("validate"); rules != "" {
+			validateField(bindErr, name, fv, rules, fieldGiven != nil)
+		}
+		if fv.Kind() == reflect.Struct || (fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct) {
+			validateStruct(bindErr, fv, name+".", fieldGiven)
+		}
+	}
+}
+
+func validateField(bindErr *BindError, name string, v reflect.Value, rules string, given bool) {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		ruleName, arg := rule, ""
+		if eq := strings.IndexByte(rule, '='); eq >= 0 {
+			ruleName, arg = rule[:eq], rule[eq+1:]
+		}
+
+		if ruleName == "required" {
+			if !given || isEmptyValue(v) {
+				bindErr.add(name, ruleName, "is required")
+				// No point checking anything else
+				return
+			}
+			continue
+		}
+
+		if !given || v.Kind() == reflect.Ptr {
+			// Optional and absent, or null
+			return
+		}
+
+		switch ruleName {
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				bindErr.add(name, ruleName, "bad validation rule: "+rule)
+				continue
+			}
+			size, isLength, ok := validationSize(v)
+			if !ok {
+				continue
+			}
+			what := "must be"
+			if isLength {
+				what = "length must be"
+			}
+			if ruleName == "min" && size < limit {
+				bindErr.add(name, ruleName, fmt.Sprintf("%s at least %s", what, arg))
+			}
+			if ruleName == "max" && size > limit {
+				bindErr.add(name, ruleName, fmt.Sprintf("%s at most %s", what, arg))
+			}
+		case "regex":
+			re, err := validationRegexp(arg)
+			if err != nil {
+				bindErr.add(name, ruleName, "bad validation rule: "+rule)
+				continue
+			}
+			if v.Kind() == reflect.String && !re.MatchString(v.String()) {
+				bindErr.add(name, ruleName, "must match "+arg)
+			}
+		case "enum":
+			allowed := strings.Split(arg, "|")
+			s := fmt.Sprint(v.Interface())
+			found := false
+			for _, a := range allowed {
+				if s == a {
+					found = true
+					break
+				}
+			}
+			if !found {
+				bindErr.add(name, ruleName, "must be one of "+strings.Join(allowed, ", "))
+			}
+		default:
+			bindErr.add(name, ruleName, "unknown validation rule: "+rule)
+		}
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// Numbers are compared by value, everything else with a length by length
+func validationSize(v reflect.Value) (size float64, isLength bool, ok bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false, true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true, true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true, true
+	}
+	return 0, false, false
+}
@@ -0,0 +1,133 @@
+package gop
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+type bindFilter struct {
+	Limit int `schema:"limit" json:"limit" xml:"limit" validate:"min=1,max=50"`
+}
+
+type bindSearch struct {
+	ID       int        `schema:"id" json:"id" validate:"min=1"`
+	Query    string     `schema:"q" json:"q" xml:"q" validate:"required,max=10"`
+	Page     int        `schema:"page" json:"page" xml:"page" validate:"min=1"`
+	Sort     string     `schema:"sort" json:"sort" xml:"sort" validate:"enum=asc|desc"`
+	Tag      string     `schema:"tag" json:"tag" xml:"tag" validate:"regex=^[a-z]+$"`
+	Count    int        `schema:"count" json:"count" xml:"count" validate:"required"`
+	Archived bool       `schema:"archived" json:"archived" xml:"archived" validate:"required"`
+	Filter   bindFilter `schema:"filter" json:"filter" xml:"filter"`
+}
+
+// The fields Bind complained about, as "field:rule"
+func bindFailures(t *testing.T, a *App, method, url, contentType, body string) []string {
+	var headers map[string]string
+	if contentType != "" {
+		headers = map[string]string{"Content-Type": contentType}
+	}
+	w := doRequest(a, method, url, strings.NewReader(body), headers)
+	if w.Code == http.StatusOK {
+		return []string{}
+	}
+	test.Is(t, w.Code, http.StatusBadRequest, url+" status")
+	var resp struct {
+		Fields []FieldError `json:"fields"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	failures := []string{}
+	for _, fe := range resp.Fields {
+		failures = append(failures, fe.Field+":"+fe.Rule)
+	}
+	return failures
+}
+
+func newBindApp(t *testing.T) *App {
+	a := newTestApp(t, nil)
+	handler := func(g *Req) error {
+		var s bindSearch
+		if err := g.Bind(&s); err != nil {
+			return err
+		}
+		return g.SendText([]byte("ok"))
+	}
+	a.HandleFunc("/search", handler)
+	a.HandleFunc("/items/{id}", handler)
+	return a
+}
+
+func TestBindForm(t *testing.T) {
+	a := newBindApp(t)
+	cases := []struct {
+		query string
+		fails []string
+	}{
+		{"q=go&count=0&archived=false", []string{}},
+		{"q=go&count=3&archived=true&page=2&sort=asc&tag=abc&filter.limit=5", []string{}},
+		{"count=0&archived=false", []string{"q:required"}},
+		{"q=&count=0&archived=false", []string{"q:required"}},
+		{"q=go&archived=false", []string{"count:required"}},
+		{"q=go&count=1", []string{"archived:required"}},
+		{"q=go&count=0&archived=false&page=0", []string{"page:min"}},
+		{"q=go&count=0&archived=false&page=-1", []string{"page:min"}},
+		{"q=go&count=0&archived=false&filter.limit=0", []string{"filter.limit:min"}},
+		{"q=go&count=0&archived=false&filter.limit=51", []string{"filter.limit:max"}},
+		{"q=much+too+long&count=0&archived=false", []string{"q:max"}},
+		{"q=go&count=0&archived=false&sort=up", []string{"sort:enum"}},
+		{"q=go&count=0&archived=false&tag=ABC", []string{"tag:regex"}},
+		{"page=0&sort=up", []string{"q:required", "page:min", "sort:enum", "count:required", "archived:required"}},
+		{"q=go&count=zero&archived=false", []string{"count:decode"}},
+	}
+	for _, c := range cases {
+		test.Is(t, bindFailures(t, a, "GET", "/search?"+c.query, "", ""), c.fails, c.query)
+		test.Is(t, bindFailures(t, a, "POST", "/search", "application/x-www-form-urlencoded", c.query), c.fails, "form body "+c.query)
+	}
+}
+
+func TestBindPathVars(t *testing.T) {
+	a := newBindApp(t)
+	test.Is(t, bindFailures(t, a, "GET", "/items/3?q=go&count=0&archived=false", "", ""), []string{}, "id=3")
+	test.Is(t, bindFailures(t, a, "GET", "/items/0?q=go&count=0&archived=false", "", ""), []string{"id:min"}, "id=0")
+}
+
+func TestBindJSON(t *testing.T) {
+	a := newBindApp(t)
+	cases := []struct {
+		body  string
+		fails []string
+	}{
+		{`{"q": "go", "count": 0, "archived": false}`, []string{}},
+		{`{"q": "go", "count": 0, "archived": false, "page": 0}`, []string{"page:min"}},
+		{`{"q": "go", "count": 0, "archived": false, "filter": {}}`, []string{}},
+		{`{"q": "go", "count": 0, "archived": false, "filter": {"limit": 0}}`, []string{"filter.limit:min"}},
+		{`{"count": 0, "archived": false}`, []string{"q:required"}},
+		{`{"q": "go"}`, []string{"count:required", "archived:required"}},
+		{`{"q": `, []string{"body:decode"}},
+	}
+	for _, c := range cases {
+		test.Is(t, bindFailures(t, a, "POST", "/search", "application/json", c.body), c.fails, c.body)
+	}
+	// The query string adds to the body
+	test.Is(t, bindFailures(t, a, "POST", "/search?page=0", "application/json", `{"q": "go", "count": 0, "archived": false}`),
+		[]string{"page:min"}, "query with JSON body")
+}
+
+func TestBindXML(t *testing.T) {
+	a := newBindApp(t)
+	cases := []struct {
+		body  string
+		fails []string
+	}{
+		{`<search><q>go</q><count>0</count><archived>false</archived></search>`, []string{}},
+		{`<search><q>go</q><count>0</count><archived>false</archived><page>0</page></search>`, []string{"page:min"}},
+		{`<search><q>go</q><count>0</count><archived>false</archived><filter><limit>0</limit></filter></search>`, []string{"filter.limit:min"}},
+		{`<search><count>0</count><archived>false</archived></search>`, []string{"q:required"}},
+	}
+	for _, c := range cases {
+		test.Is(t, bindFailures(t, a, "POST", "/search", "application/xml", c.body), c.fails, c.body)
+	}
+}
@@ -0,0 +1,222 @@
+package gop
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response compression, negotiated from Accept-Encoding. Enabled with [gop] compress_enable.
+// Responses are buffered until we have compress_min_bytes (or the handler finishes or
+// flushes), so small responses go out as they are. Only the mime types in compress_types
+// are compressed, and never a response which already has a Content-Encoding.
+
+// Makes a compressing writer for an encoding. Register with App.RegisterCompressor.
+type Compressor func(w io.Writer) io.WriteCloser
+
+// Preferred encodings, best first, for when the client rates them equally
+var compressionPreference = []string{"br", "gzip", "deflate"}
+
+func defaultCompressors() map[string]Compressor {
+	return map[string]Compressor{
+		"gzip": func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		"deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+}
+
+// Add (or replace) the compressor for a content coding, e.g. "br". Call before Run().
+func (a *App) RegisterCompressor(encoding string, c Compressor) {
+	a.compressors[strings.ToLower(encoding)] = c
+}
+
+type compression struct {
+	encoding string
+	newCW    Compressor
+	minSize  int
+	types    []string
+	buf      bytes.Buffer
+	decided  bool
+	cw       io.WriteCloser // nil if we decided not to compress
+}
+
+var defaultCompressTypes = "text/html,text/plain,text/css,text/csv,text/javascript,application/json,application/javascript,application/xml,image/svg+xml"
+
+// Pick the encoding for the request. nil if compression is off or the client doesn't
+// accept anything we have.
+func (a *App) negotiateCompression(r *http.Request) *compression {
+	enabled := a.configBool("gop", "compress_enable", false)
+	if !enabled || r.Method == "HEAD" {
+		return nil
+	}
+	accept := r.Header.Get("Accept-Encoding")
+	if accept == "" {
+		return nil
+	}
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		qs[coding] = q
+	}
+	qFor := func(coding string) float64 {
+		if q, ok := qs[coding]; ok {
+			return q
+		}
+		if q, ok := qs["*"]; ok {
+			return q
+		}
+		return 0
+	}
+
+	encodings := append([]string{}, compressionPreference...)
+	for enc := range a.compressors {
+		if !stringIn(enc, encodings) {
+			encodings = append(encodings, enc)
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range encodings {
+		if a.compressors[enc] == nil {
+			continue
+		}
+		if q := qFor(enc); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	if best == "" {
+		return nil
+	}
+
+	minSize := a.configInt("gop", "compress_min_bytes", 1024)
+	types, _ := a.Cfg.GetList("gop", "compress_types", strings.Split(defaultCompressTypes, ","))
+	return &compression{
+		encoding: best,
+		newCW:    a.compressors[best],
+		minSize:  minSize,
+		types:    types,
+	}
+}
+
+func stringIn(s string, ss []string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Should we compress the response? Needs the headers to be final.
+func (c *compression) wanted(w *responseWriter) bool {
+	switch w.code {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	h := w.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(c.buf.Bytes())
+		h.Set("Content-Type", contentType)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Make up our mind, send the headers and whatever we've buffered. Must hold the lock.
+func (c *compression) decide(w *responseWriter, force bool) error {
+	if c.decided || (!force && c.buf.Len() < c.minSize) {
+		return nil
+	}
+	c.decided = true
+	if c.buf.Len() > 0 && c.buf.Len() >= c.minSize && c.wanted(w) {
+		h := w.ResponseWriter.Header()
+		h.Set("Content-Encoding", c.encoding)
+		h.Add("Vary", "Accept-Encoding")
+		h.Del("Content-Length")
+		c.cw = c.newCW(wireWriter{w})
+	}
+	w.sendHeader()
+	buffered := c.buf.Bytes()
+	c.buf = bytes.Buffer{}
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if c.cw != nil {
+		_, err = c.cw.Write(buffered)
+	} else {
+		_, err = w.wireWrite(buffered)
+	}
+	return err
+}
+
+// Must hold the lock
+func (c *compression) write(w *responseWriter, buf []byte) (int, error) {
+	if !c.decided {
+		c.buf.Write(buf)
+		return len(buf), c.decide(w, false)
+	}
+	if c.cw != nil {
+		return c.cw.Write(buf)
+	}
+	return w.wireWrite(buf)
+}
+
+// Must hold the lock
+func (c *compression) flush(w *responseWriter) {
+	c.decide(w, true)
+	if f, ok := c.cw.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+}
+
+// Must hold the lock
+func (c *compression) close(w *responseWriter) {
+	c.decide(w, true)
+	if c.cw != nil {
+		c.cw.Close()
+		c.cw = nil
+	}
+}
+
+// Lets the compressor write to the client while we hold the responseWriter lock
+type wireWriter struct {
+	w *responseWriter
+}
+
+func (ww wireWriter) Write(buf []byte) (int, error) {
+	return ww.w.wireWrite(buf)
+}
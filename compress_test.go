@@ -0,0 +1,115 @@
+package gop
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+var bigText = strings.Repeat("all work and no play makes jack a dull boy\n", 100)
+
+func newCompressApp(t *testing.T, cfg map[string]string) *App {
+	if cfg == nil {
+		cfg = map[string]string{"compress_enable": "true"}
+	}
+	a := newTestApp(t, ConfigMap{"gop": cfg})
+	a.HandleFunc("/big", func(g *Req) error {
+		return g.SendText([]byte(bigText))
+	})
+	a.HandleFunc("/small", func(g *Req) error {
+		return g.SendText([]byte("tiny"))
+	})
+	a.HandleFunc("/png", func(g *Req) error {
+		g.W.Header().Set("Content-Type", "image/png")
+		g.W.Write([]byte(bigText))
+		return nil
+	})
+	a.HandleFunc("/encoded", func(g *Req) error {
+		g.W.Header().Set("Content-Type", "text/plain")
+		g.W.Header().Set("Content-Encoding", "identity")
+		g.W.Write([]byte(bigText))
+		return nil
+	})
+	return a
+}
+
+func compressedGet(a *App, url, acceptEncoding string) (*http.Response, string) {
+	w := doRequest(a, "GET", url, nil, map[string]string{"Accept-Encoding": acceptEncoding})
+	resp := w.Result()
+	var r io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		r, _ = gzip.NewReader(r)
+	case "deflate":
+		r = flate.NewReader(r)
+	}
+	body, _ := io.ReadAll(r)
+	return resp, string(body)
+}
+
+func TestCompression(t *testing.T) {
+	a := newCompressApp(t, nil)
+	resp, body := compressedGet(a, "/big", "gzip")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "gzip", "gzipped")
+	test.Is(t, resp.Header.Get("Vary"), "Accept-Encoding", "Vary")
+	test.Is(t, resp.Header.Get("Content-Length"), "", "no Content-Length")
+	test.Is(t, body, bigText, "gzipped body")
+	test.OK(t, hasStat(a, "http_bytes_uncompressed:"+strconv.Itoa(len(bigText))+"|c"), "uncompressed bytes counted")
+
+	resp, body = compressedGet(a, "/big", "deflate")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "deflate", "deflated")
+	test.Is(t, body, bigText, "deflated body")
+
+	resp, body = compressedGet(a, "/small", "gzip")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "", "small response not compressed")
+	test.Is(t, body, "tiny", "small body")
+	resp, body = compressedGet(a, "/png", "gzip")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "", "other types not compressed")
+	test.Is(t, body, bigText, "png body")
+	resp, body = compressedGet(a, "/encoded", "gzip")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "identity", "existing encoding kept")
+	test.Is(t, body, bigText, "encoded body")
+
+	w := doRequest(a, "HEAD", "/big", nil, map[string]string{"Accept-Encoding": "gzip"})
+	test.Is(t, w.Header().Get("Content-Encoding"), "", "HEAD not compressed")
+
+	a = newCompressApp(t, map[string]string{})
+	resp, body = compressedGet(a, "/big", "gzip")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "", "off by default")
+	test.Is(t, body, bigText, "body when off")
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	a := newCompressApp(t, nil)
+	cases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"*", "gzip"},
+		{"*;q=0.5, gzip;q=0.1", "deflate"},
+		{"gzip;q=0", ""},
+		{"GZIP", "gzip"},
+	}
+	for _, c := range cases {
+		resp, _ := compressedGet(a, "/big", c.acceptEncoding)
+		test.Is(t, resp.Header.Get("Content-Encoding"), c.want, "Accept-Encoding: "+c.acceptEncoding)
+	}
+
+	// Registered encodings are preferred as the built-in order says
+	a.RegisterCompressor("br", func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	})
+	resp, _ := compressedGet(a, "/big", "gzip, br")
+	test.Is(t, resp.Header.Get("Content-Encoding"), "br", "br preferred")
+}
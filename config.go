@@ -395,3 +395,64 @@ func (cfg *Config) GetMap(sectionName, kPrefix string, defaultValue map[string]s
       }
       return v, true
 }
+
+// Read config while serving. A bad value (e.g. PUT via /gop/config) is logged and the
+// default used, rather than panicking as the Cfg.Get* helpers do and taking the
+// requestMaker (and so the whole server) down with it.
+func (a *App) safeConfig(sectionName, optionName string, parse func(v string) error) {
+	v, found := a.Cfg.Get(sectionName, optionName, "")
+	if !found {
+		return
+	}
+	if err := parse(strings.TrimSpace(v)); err != nil {
+		a.Errorf("Bad config value [%s] %s = %q: %s - using the default", sectionName, optionName, v, err.Error())
+	}
+}
+
+func (a *App) configInt(sectionName, optionName string, defaultValue int) int {
+	r := defaultValue
+	a.safeConfig(sectionName, optionName, func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err == nil {
+			r = n
+		}
+		return err
+	})
+	return r
+}
+
+func (a *App) configInt64(sectionName, optionName string, defaultValue int64) int64 {
+	r := defaultValue
+	a.safeConfig(sectionName, optionName, func(v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			r = n
+		}
+		return err
+	})
+	return r
+}
+
+func (a *App) configFloat(sectionName, optionName string, defaultValue float64) float64 {
+	r := defaultValue
+	a.safeConfig(sectionName, optionName, func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			r = f
+		}
+		return err
+	})
+	return r
+}
+
+func (a *App) configBool(sectionName, optionName string, defaultValue bool) bool {
+	r := defaultValue
+	a.safeConfig(sectionName, optionName, func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			r = b
+		}
+		return err
+	})
+	return r
+}
@@ -0,0 +1,57 @@
+package gop
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestSafeConfig(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {
+		"int":   " 12 ",
+		"float": "0.5",
+		"bool":  "true",
+		"bad":   "lots",
+	}})
+	test.Is(t, a.configInt("gop", "int", 1), 12, "int")
+	test.Is(t, a.configInt64("gop", "int", 1), int64(12), "int64")
+	test.Is(t, a.configFloat("gop", "float", 1), 0.5, "float")
+	test.Is(t, a.configBool("gop", "bool", false), true, "bool")
+	test.Is(t, a.configInt("gop", "missing", 3), 3, "missing")
+	test.Is(t, a.configInt("gop", "bad", 3), 3, "bad int")
+	test.Is(t, a.configInt64("gop", "bad", 3), int64(3), "bad int64")
+	test.Is(t, a.configFloat("gop", "bad", 3), 3.0, "bad float")
+	test.Is(t, a.configBool("gop", "bad", true), true, "bad bool")
+}
+
+// Values PUT via /gop/config are read per request, some of them on the requestMaker
+// goroutine, and mustn't be able to take the server down
+func TestBadConfigKeepsServing(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.HandleFunc("/hello", func(g *Req) error {
+		return g.SendText([]byte("hello"))
+	})
+	for _, option := range []string{
+		"statsd_route_prefix",
+		"trust_request_id_header",
+		"max_body_bytes",
+		"max_concurrent_requests",
+		"compress_enable",
+		"hide_internal_errors",
+		"use_xf_headers",
+	} {
+		a.Cfg.TransientOverride("gop", option, "bogus")
+	}
+	a.Cfg.TransientOverride("slo", "enable", "bogus")
+	w := doRequest(a, "GET", "/hello", nil, map[string]string{"Accept-Encoding": "gzip"})
+	test.Is(t, w.Code, http.StatusOK, "served")
+	test.Is(t, w.Body.String(), "hello", "body")
+	test.Is(t, len(openRequests(a)), 0, "requestMaker still running")
+
+	// Timed handlers run in their own goroutine
+	a.Cfg.TransientOverride("gop", "request_timeout", "1s")
+	w = doRequest(a, "POST", "/hello", strings.NewReader("a=1"), map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	test.Is(t, w.Code, http.StatusOK, "timed request served")
+}
@@ -0,0 +1,218 @@
+package gop
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const reqContextKey contextKey = 0
+
+// The request context. Derived from R.Context(), so it is cancelled if the client goes
+// away, and carries the *Req (see ReqFromContext) and any route timeout as its deadline.
+// Pass it to anything (db calls, outbound http) which should stop when the request does.
+func (g *Req) Context() context.Context {
+	return g.ctx
+}
+
+// The gop request a context belongs to, for its request id and logging, or nil
+func ReqFromContext(ctx context.Context) *Req {
+	g, _ := ctx.Value(reqContextKey).(*Req)
+	return g
+}
+
+// The request id a context belongs to, or "" if none
+func RequestIDFromContext(ctx context.Context) string {
+	g := ReqFromContext(ctx)
+	if g == nil {
+		return ""
+	}
+	return g.requestID
+}
+
+// The hard timeout for a route: [request_timeouts] <route>, else any set in code with
+// Route.Timeout, else [gop] request_timeout. Zero for none. A negative codeTimeout means
+// the route doesn't get [gop] request_timeout.
+func (a *App) routeTimeout(routeName string, codeTimeout time.Duration) time.Duration {
+	timeout := codeTimeout
+	if timeout < 0 {
+		timeout = 0
+	} else if timeout == 0 {
+		timeout, _ = a.Cfg.GetDuration("gop", "request_timeout", 0)
+	}
+	timeout, _ = a.Cfg.GetDuration("request_timeouts", routeName, timeout)
+	return timeout
+}
+
+// Set up the request context. g.cancel must be called when the request is done.
+func (g *Req) initContext() {
+	ctx := context.WithValue(g.R.Context(), reqContextKey, g)
+	if g.timeout > 0 {
+		g.ctx, g.cancel = context.WithTimeout(ctx, g.timeout)
+	} else {
+		g.ctx, g.cancel = context.WithCancel(ctx)
+	}
+	g.R = g.R.WithContext(g.ctx)
+}
+
+// Called (from the http serving goro) when the handler has overrun its timeout. We send
+// a 503 if we can, and discard anything the handler writes from now on.
+func (g *Req) hardTimeout() {
+	w := g.W
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.done {
+		// Finished just in time
+		return
+	}
+	g.Errorf("Request timed out after %s - abandoning handler", g.timeout)
+	g.app.Stats.Inc("http_timeouts", 1)
+	g.Stats.Inc("timeouts", 1)
+
+	buffered, ok := w.ResponseWriter.(*timeoutWriter)
+	if ok && !buffered.committed {
+		tw := &responseWriter{code: 200, ResponseWriter: buffered.w}
+		g.sendErrorTo(tw, HTTPError{Code: http.StatusServiceUnavailable, Body: "Request timed out", ErrorCode: "timeout"})
+		w.code = tw.code
+		w.size = tw.size
+		w.wireSize = tw.wireSize
+	}
+	w.timedOut = true
+}
+
+// The handler's side of the response on routes with a timeout, as with
+// http.TimeoutHandler: it gets its own headers, and the response is held here until
+// the handler finishes (or flushes), so that nothing it does can clash with the 503 we
+// send if it overruns. Only used under the responseWriter lock.
+type timeoutWriter struct {
+	w           http.ResponseWriter // the client's
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+	committed   bool // passed on to the client, so writes now go straight through
+	clientGone  <-chan struct{}
+}
+
+func newTimeoutWriter(w http.ResponseWriter, clientGone <-chan struct{}) *timeoutWriter {
+	return &timeoutWriter{w: w, header: make(http.Header), code: http.StatusOK, clientGone: clientGone}
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	if tw.committed {
+		tw.w.WriteHeader(code)
+		return
+	}
+	if !tw.wroteHeader {
+		tw.code = code
+		tw.wroteHeader = true
+	}
+}
+
+func (tw *timeoutWriter) Write(buf []byte) (int, error) {
+	if tw.committed {
+		return tw.w.Write(buf)
+	}
+	tw.wroteHeader = true
+	return tw.body.Write(buf)
+}
+
+// Streaming responses can't be held back
+func (tw *timeoutWriter) Flush() {
+	tw.commit()
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Deprecated: use g.Context().Done()
+func (tw *timeoutWriter) CloseNotify() <-chan bool {
+	return closeNotify(tw.w, tw.clientGone)
+}
+
+// Taking over the connection commits whatever the handler has sent so far, and we
+// can't send a 503 on it afterwards.
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	tw.commit()
+	return hijacker.Hijack()
+}
+
+// For http.ResponseController
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// Pass what the handler has sent on to the client
+func (tw *timeoutWriter) commit() {
+	if tw.committed {
+		return
+	}
+	tw.committed = true
+	dst := tw.w.Header()
+	for k, v := range tw.header {
+		dst[k] = append([]string(nil), v...)
+	}
+	if !tw.wroteHeader {
+		return
+	}
+	tw.w.WriteHeader(tw.code)
+	if tw.body.Len() > 0 {
+		tw.w.Write(tw.body.Bytes())
+		tw.body.Reset()
+	}
+}
+
+// The request body on routes with a timeout. Once we've given up on the handler, it
+// can't read any more - the server is done with the request.
+type timeoutBody struct {
+	io.ReadCloser
+	w *responseWriter
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	if b.w.isTimedOut() {
+		return 0, http.ErrHandlerTimeout
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// Set up the request to run under a timeout
+func (g *Req) bufferForTimeout() {
+	g.W.ResponseWriter = newTimeoutWriter(g.W.ResponseWriter, g.W.clientGone)
+	if g.R.Body != nil && g.R.Body != http.NoBody {
+		g.R.Body = &timeoutBody{ReadCloser: g.R.Body, w: g.W}
+	}
+}
+
+// Turn errors resulting from the request context ending into something sensible for the client
+func (g *Req) contextError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case g.ctx.Err() == context.DeadlineExceeded:
+		g.Errorf("Request timed out after %s: %s", g.timeout, err.Error())
+		return HTTPError{Code: http.StatusServiceUnavailable, Body: "Request timed out", ErrorCode: "timeout"}
+	case g.ctx.Err() == context.Canceled:
+		g.Info("Request cancelled (client went away?): %s", err.Error())
+		return err
+	case err == context.DeadlineExceeded:
+		// Not our deadline, so something we called timed out
+		return HTTPError{Code: http.StatusGatewayTimeout, Body: "Upstream timed out", ErrorCode: "upstream_timeout"}
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+package gop
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestTimeoutAbandonsHandler(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"request_timeout": "50ms"}})
+	writeErr := make(chan error, 1)
+	a.HandleFunc("/slow", func(g *Req) error {
+		// Keep changing headers right through the timeout
+		for g.Context().Err() == nil {
+			g.W.Header().Set("X-Handler", "yes")
+		}
+		time.Sleep(20 * time.Millisecond)
+		g.W.Header().Set("X-Late", "yes")
+		g.W.WriteHeader(http.StatusCreated)
+		_, err := g.W.Write([]byte("late"))
+		writeErr <- err
+		return nil
+	})
+
+	w := doRequest(a, "GET", "/slow", nil, nil)
+	test.Is(t, w.Code, http.StatusServiceUnavailable, "timed out request gets a 503")
+	test.Is(t, w.Header().Get("X-Handler"), "", "handler's headers aren't sent")
+	test.OK(t, w.Header().Get("X-Request-Id") != "", "503 has the request id")
+	test.Is(t, <-writeErr, http.ErrHandlerTimeout, "handler writes after the timeout fail")
+	test.OK(t, !strings.Contains(w.Body.String(), "late"), "late body isn't sent")
+	test.OK(t, hasStat(a, "http_timeouts:1|c"), "timeout counted")
+}
+
+func TestTimeoutBlocksBodyReads(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"request_timeout": "30ms"}})
+	readErr := make(chan error, 1)
+	a.HandleFunc("/upload", func(g *Req) error {
+		<-g.Context().Done()
+		time.Sleep(20 * time.Millisecond)
+		_, err := io.ReadAll(g.R.Body)
+		readErr <- err
+		return nil
+	})
+	w := doRequest(a, "POST", "/upload", strings.NewReader("some data"), map[string]string{"Content-Type": "application/octet-stream"})
+	test.Is(t, w.Code, http.StatusServiceUnavailable, "timed out upload gets a 503")
+	test.Is(t, <-readErr, http.ErrHandlerTimeout, "body reads after the timeout fail")
+}
+
+func TestTimeoutHandlerInTime(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"request_timeout": "1s"}})
+	a.HandleFunc("/quick", func(g *Req) error {
+		body, _ := io.ReadAll(g.R.Body)
+		g.W.Header().Set("X-Handler", "yes")
+		g.W.WriteHeader(http.StatusCreated)
+		g.W.Write(body)
+		return nil
+	})
+	a.HandleFunc("/stream", func(g *Req) error {
+		g.W.Write([]byte("first "))
+		g.W.Flush()
+		g.W.Write([]byte("second"))
+		return nil
+	})
+
+	w := doRequest(a, "POST", "/quick", strings.NewReader("echo"), map[string]string{"Content-Type": "application/octet-stream"})
+	test.Is(t, w.Code, http.StatusCreated, "handler's status sent")
+	test.Is(t, w.Header().Get("X-Handler"), "yes", "handler's headers sent")
+	test.Is(t, w.Body.String(), "echo", "handler's body sent")
+
+	w = doRequest(a, "GET", "/stream", nil, nil)
+	test.Is(t, w.Body.String(), "first second", "flushed response sent")
+	test.OK(t, w.Flushed, "flush passed through")
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	a := newTestApp(t, ConfigMap{
+		"gop":              {"request_timeout": "1s"},
+		"request_timeouts": {"configured": "3s"},
+	})
+	test.Is(t, a.routeTimeout("plain", 0), time.Second, "app-wide timeout")
+	test.Is(t, a.routeTimeout("plain", 2*time.Second), 2*time.Second, "code timeout beats app-wide")
+	test.Is(t, a.routeTimeout("configured", 2*time.Second), 3*time.Second, "config beats code")
+	test.Is(t, a.routeTimeout("plain", -1), time.Duration(0), "long-lived routes don't get the app-wide timeout")
+}
+
+func TestContextCarriesReq(t *testing.T) {
+	a := newTestApp(t, nil)
+	var ctx context.Context
+	a.HandleFunc("/x", func(g *Req) error {
+		ctx = g.Context()
+		test.OK(t, ReqFromContext(ctx) == g, "Req from the context")
+		test.Is(t, RequestIDFromContext(ctx), g.RequestID(), "request id from the context")
+		test.OK(t, g.R.Context() == ctx, "request carries the context")
+		test.ErrIs(t, ctx.Err(), nil, "live during the request")
+		return g.SendText([]byte("ok"))
+	})
+	doRequest(a, "GET", "/x", nil, nil)
+	test.Is(t, ctx.Err(), context.Canceled, "cancelled once the request is done")
+	test.OK(t, ReqFromContext(context.Background()) == nil, "no Req")
+	test.Is(t, RequestIDFromContext(context.Background()), "", "no request id")
+}
+
+func TestContextCancellation(t *testing.T) {
+	a := newTestApp(t, nil)
+	started := make(chan bool)
+	gone := make(chan error, 1)
+	a.HandleFunc("/wait", func(g *Req) error {
+		started <- true
+		<-g.Context().Done()
+		gone <- g.Context().Err()
+		return g.Context().Err()
+	})
+	a.HandleFunc("/upstream", func(g *Req) error {
+		ctx, cancel := context.WithTimeout(g.Context(), time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// The client going away cancels the request
+	clientCtx, cancelClient := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/wait", nil).WithContext(clientCtx)
+	go func() {
+		<-started
+		cancelClient()
+	}()
+	doRequestFrom(a, r)
+	test.Is(t, <-gone, context.Canceled, "handler sees the client go")
+
+	// A deadline that isn't the request's is an upstream timeout
+	w := doRequest(a, "GET", "/upstream", nil, nil)
+	test.Is(t, w.Code, http.StatusGatewayTimeout, "upstream timeout status")
+}
+
+func TestCloseNotifyOnTimedRoute(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"request_timeout": "5s"}})
+	started := make(chan bool)
+	notified := make(chan bool, 1)
+	a.HandleFunc("/wait", func(g *Req) error {
+		notify := g.W.CloseNotify()
+		started <- true
+		select {
+		case <-notify:
+			notified <- true
+		case <-time.After(time.Second):
+			notified <- false
+		}
+		return nil
+	})
+
+	// The recorder can't CloseNotify, so this goes by the client's context
+	clientCtx, cancelClient := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/wait", nil).WithContext(clientCtx)
+	go func() {
+		<-started
+		cancelClient()
+	}()
+	doRequestFrom(a, r)
+	test.OK(t, <-notified, "notified the client went, via the context")
+
+	// The server's writer can
+	addr := serveTestApp(t, a)
+	conn, err := net.Dial("tcp", addr)
+	test.ErrIs(t, err, nil, "dial")
+	io.WriteString(conn, "GET /wait HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-started
+	conn.Close()
+	test.OK(t, <-notified, "notified the client went, via the server")
+}
+
+func TestHijackOnTimedRoute(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"request_timeout": "100ms"}})
+	a.HandleFunc("/raw", func(g *Req) error {
+		conn, rw, err := g.W.Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// Well past the timeout, which mustn't write its 503 on our connection
+		time.Sleep(200 * time.Millisecond)
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 3\r\nConnection: close\r\n\r\nraw")
+		return rw.Flush()
+	})
+	addr := serveTestApp(t, a)
+	resp, err := http.Get("http://" + addr + "/raw")
+	test.ErrIs(t, err, nil, "get")
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	test.Is(t, resp.StatusCode, http.StatusOK, "hijacked response status")
+	test.Is(t, string(body), "raw", "hijacked response body")
+
+	// Nothing to hijack with a recorder
+	a.HandleFunc("/recorded", func(g *Req) error {
+		_, _, err := g.W.Hijack()
+		test.ErrIs(t, err, http.ErrNotSupported, "recorder can't be hijacked")
+		return g.SendText([]byte("ok"))
+	})
+	w := doRequest(a, "GET", "/recorded", nil, nil)
+	test.Is(t, w.Code, http.StatusOK, "served without hijacking")
+}
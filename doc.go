@@ -90,6 +90,11 @@ GOP provides a few HTTP handlers, all beginning with "/gop", that you can enable
 true in the [gop] section of your configuration file. Otherwise, GOP will respond with "not enabled" when you
 will try to access those handlers.
 
+They can be moved off the app's public port onto their own listener (admin_listen_addr), limited to
+admin_allow_cidrs and protected with a bearer token (admin_token) or basic auth (admin_user and
+admin_password). Every call which may change something, such as a config PUT, is written to the admin
+audit log.
+
 The following handlers are available:
 
   /gop/config/:section/:key
@@ -100,21 +105,25 @@ The following handlers are available:
     When the HTTP verb is not PUT, :section and :key are ignored and the method returns the complete config,
     including any overrides. In fact, you can omit :section and :key altogether, i.e. "/gop/config" will suffice.
 
- /gop/status
+  /gop/status
 
     TODO
 
- /gop/stack
+  /gop/stack
 
     TODO
 
- /gop/mem
+  /gop/mem
 
     TODO
 
- /gop/test?secs=int&kbytes=int
+  /gop/test?secs=int&kbytes=int
 
     TODO
 
+  /gop/slo
+
+    Rolling availability and latency SLOs, with burn rates, for each route. See the [slo] config section.
+
 */
 package gop
@@ -0,0 +1,108 @@
+package gop
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Renders an error response to the client. Replaces the error_format config if set
+// with App.SetErrorRenderer.
+type ErrorRenderer func(g *Req, err HTTPError)
+
+// Errors other than HTTPError which can describe themselves as one, e.g. BindError
+type httpErrorer interface {
+	HTTPError() HTTPError
+}
+
+// Use a custom renderer for all error responses (returned errors and panics)
+func (a *App) SetErrorRenderer(r ErrorRenderer) {
+	a.errorRenderer = r
+}
+
+// RFC 7807 problem details
+type problemDetails struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Detail    string      `json:"detail,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	Code      string      `json:"code,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// Message for the client in place of an internal error, if hide_internal_errors is set
+func (g *Req) hiddenErrorMessage() string {
+	return "Internal error [request " + g.requestID + "]"
+}
+
+// Send an error returned from (or panic'd by) a handler
+func (g *Req) sendError(err error) {
+	g.sendErrorTo(g.W, err)
+}
+
+// As sendError, but to a specific writer. The custom renderer only writes to g.W.
+func (g *Req) sendErrorTo(w *responseWriter, err error) {
+	var httpErr HTTPError
+	switch e := err.(type) {
+	case HTTPError:
+		httpErr = e
+	case httpErrorer:
+		httpErr = e.HTTPError()
+	default:
+		httpErr = HTTPError{
+			Code: http.StatusInternalServerError,
+			Body: "Internal error: " + err.Error(),
+		}
+		hide := g.app.configBool("gop", "hide_internal_errors", false)
+		if hide {
+			g.Errorf("Internal error: %s", err.Error())
+			httpErr.Body = g.hiddenErrorMessage()
+		}
+	}
+
+	if g.app.errorRenderer != nil && w == g.W {
+		g.app.errorRenderer(g, httpErr)
+		return
+	}
+	format, _ := g.Cfg.Get("gop", "error_format", "text")
+	switch format {
+	case "problem_json":
+		g.sendProblemJSON(w, httpErr)
+	default:
+		respErr, ok := err.(responseError)
+		if ok {
+			respErr.Write(w)
+		} else {
+			httpErr.Write(w)
+		}
+	}
+}
+
+func (g *Req) sendProblemJSON(w *responseWriter, httpErr HTTPError) {
+	problem := problemDetails{
+		Type:      "about:blank",
+		Title:     http.StatusText(httpErr.Code),
+		Status:    httpErr.Code,
+		Detail:    strings.TrimSpace(httpErr.Body),
+		Instance:  g.R.URL.RequestURI(),
+		Code:      httpErr.ErrorCode,
+		Details:   httpErr.Details,
+		RequestID: g.requestID,
+	}
+	typeBaseURL, _ := g.Cfg.Get("gop", "error_type_base_url", "")
+	if typeBaseURL != "" && httpErr.ErrorCode != "" {
+		problem.Type = typeBaseURL + httpErr.ErrorCode
+	}
+	body, err := json.Marshal(problem)
+	if err != nil {
+		g.Errorf("Failed to encode problem details: %s", err.Error())
+		httpErr.Write(w)
+		return
+	}
+	httpErr.writeHeaders(w)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(httpErr.Code)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,112 @@
+package gop
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func newErrorsApp(t *testing.T, cfg map[string]string) *App {
+	a := newTestApp(t, ConfigMap{"gop": cfg})
+	a.HandleFunc("/user", func(g *Req) error {
+		return NotFound("No such user").(HTTPError).
+			WithErrorCode("user_not_found").
+			WithDetails(map[string]string{"id": "7"}).
+			WithHeader("X-Lookup", "users")
+	})
+	a.HandleFunc("/internal", func(g *Req) error {
+		return errors.New("db password wrong")
+	})
+	a.HandleFunc("/panic", func(g *Req) error {
+		panic("db password wrong")
+	})
+	return a
+}
+
+func problemFrom(t *testing.T, w *httptest.ResponseRecorder) problemDetails {
+	test.Is(t, w.Header().Get("Content-Type"), "application/problem+json", "problem content type")
+	var problem problemDetails
+	test.ErrIs(t, json.Unmarshal(w.Body.Bytes(), &problem), nil, "problem decodes")
+	return problem
+}
+
+func TestErrorText(t *testing.T) {
+	a := newErrorsApp(t, nil)
+	w := doRequest(a, "GET", "/user", nil, nil)
+	test.Is(t, w.Code, http.StatusNotFound, "status")
+	test.Is(t, w.Body.String(), "No such user\r\n", "body")
+	test.Is(t, w.Header().Get("X-Lookup"), "users", "WithHeader")
+
+	w = doRequest(a, "GET", "/internal", nil, nil)
+	test.Is(t, w.Code, http.StatusInternalServerError, "internal error status")
+	test.OK(t, strings.Contains(w.Body.String(), "db password wrong"), "internal error shown by default")
+
+	test.Is(t, ErrNotFound.WithHeader("X-A", "1") == ErrNotFound, false, "WithHeader copies")
+	test.Is(t, NotFound("") == ErrNotFound, true, "errors stay comparable")
+}
+
+func TestErrorProblemJSON(t *testing.T) {
+	a := newErrorsApp(t, map[string]string{
+		"error_format":        "problem_json",
+		"error_type_base_url": "https://errors.example.com/",
+	})
+	w := doRequest(a, "GET", "/user?x=1", nil, nil)
+	test.Is(t, w.Code, http.StatusNotFound, "status")
+	test.Is(t, w.Header().Get("X-Lookup"), "users", "WithHeader")
+	problem := problemFrom(t, w)
+	test.Is(t, problem.Type, "https://errors.example.com/user_not_found", "type")
+	test.Is(t, problem.Title, "Not Found", "title")
+	test.Is(t, problem.Status, http.StatusNotFound, "status in body")
+	test.Is(t, problem.Detail, "No such user", "detail")
+	test.Is(t, problem.Instance, "/user?x=1", "instance")
+	test.Is(t, problem.Code, "user_not_found", "code")
+	test.Is(t, problem.Details, map[string]interface{}{"id": "7"}, "details")
+	test.Is(t, len(problem.RequestID), 32, "request id")
+
+	// Errors without a code are about:blank
+	w = doRequest(a, "GET", "/internal", nil, nil)
+	problem = problemFrom(t, w)
+	test.Is(t, problem.Type, "about:blank", "type without a code")
+	test.Is(t, problem.Status, http.StatusInternalServerError, "internal error status")
+
+	// Bind errors carry their fields
+	b := newBindApp(t)
+	b.Cfg.source["gop"] = map[string]string{"error_format": "problem_json"}
+	w = doRequest(b, "GET", "/search?count=0&archived=false", nil, nil)
+	problem = problemFrom(t, w)
+	test.Is(t, problem.Code, "invalid_request", "bind error code")
+	fields, _ := problem.Details.([]interface{})
+	test.Is(t, len(fields), 1, "bind error fields")
+}
+
+func TestErrorHideInternal(t *testing.T) {
+	a := newErrorsApp(t, map[string]string{"hide_internal_errors": "true"})
+	for _, url := range []string{"/internal", "/panic"} {
+		w := doRequest(a, "GET", url, nil, nil)
+		test.Is(t, w.Code, http.StatusInternalServerError, url+" status")
+		test.OK(t, !strings.Contains(w.Body.String(), "password"), url+" hides the error")
+		requestID := w.Header().Get("X-Request-Id")
+		test.OK(t, requestID != "" && strings.Contains(w.Body.String(), requestID), url+" gives the request id")
+	}
+	// HTTPErrors are meant for the client
+	test.Is(t, doRequest(a, "GET", "/user", nil, nil).Body.String(), "No such user\r\n", "HTTPError shown")
+}
+
+func TestErrorRenderer(t *testing.T) {
+	a := newErrorsApp(t, map[string]string{"error_format": "problem_json"})
+	a.SetErrorRenderer(func(g *Req, err HTTPError) {
+		g.W.WriteHeader(err.Code)
+		g.W.Write([]byte("custom:" + err.ErrorCode))
+	})
+	w := doRequest(a, "GET", "/user", nil, nil)
+	test.Is(t, w.Code, http.StatusNotFound, "status")
+	test.Is(t, w.Body.String(), "custom:user_not_found", "renderer replaces error_format")
+	w = doRequest(a, "GET", "/panic", nil, nil)
+	test.Is(t, w.Code, http.StatusInternalServerError, "renderer used for panics")
+	test.OK(t, strings.HasPrefix(w.Body.String(), "custom:"), "panic rendered")
+}
@@ -66,10 +66,9 @@ func main() {
 		if err != nil {
 			return gop.BadRequest("Need to supply a duration as 'secs'")
 		}
-		cn := g.W.CloseNotify()
 		g.Error("About to sleep")
 		select {
-			case <- cn:
+			case <- g.Context().Done():
 				g.Error("Caller closed connection")
 			case <- time.After(sleepDuration):
 				g.Error("Received timeout")
@@ -1,6 +1,8 @@
 package gop
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/rcrowley/goagain"
 	"net"
 	"os"
@@ -32,6 +34,10 @@ func (a *App) goAgainSetup() {
 		a.Info("SIGUSR1 received")
 		return nil
 	}
+	goagain.OnSIGHUP = func(l net.Listener) error {
+		a.reloadTLS()
+		return nil
+	}
 }
 
 func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
@@ -45,16 +51,24 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 		if err != nil {
 			a.Fatalln(err)
 		}
+		a.openListeners(nil)
 	} else {
+		inherited, err := a.inheritListeners(ppid)
+		if err != nil {
+			a.Errorf("Failed to take over listeners from graceful parent: %s", err.Error())
+		}
+		a.openListeners(inherited)
 		// We have a parent, and we're now listening. Tell them to shut down.
 		a.Info("Child taking over from graceful parent. Killing ppid %d\n", ppid)
 		if err := goagain.KillParent(ppid); nil != err {
 			a.Fatalln(err)
 		}
 	}
+	go a.serveListenerHandover()
 	go func() {
 		a.Serve(l)
 	}()
+	a.serveListeners()
 
 	// Block the main goroutine awaiting signals.
 	if err := goagain.AwaitSignals(l); nil != err {
@@ -66,6 +80,10 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	// We're the parent. Our child has taken over the listening duties. We can close
 	// off our listener and drain pending requests.
 	l.Close()
+	a.closeListeners()
+	// Long-lived connections won't end by themselves - ask the clients to reconnect
+	// (to our child)
+	a.closeWebSockets(CloseGoingAway, "server restarting")
 	waitSecs, _ := a.Cfg.GetInt("gop", "graceful_wait_secs", 60)
 	timeoutChan := time.After(time.Second * time.Duration(waitSecs))
 
@@ -95,3 +113,113 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	a.Info("Graceful restart/exit - with %d pending reqs", a.currentReqs)
 	a.Finish()
 }
+
+// goagain only hands over the main listener. Our graceful child gets the rest from us
+// over a unix socket (in the abstract namespace, so nothing to clean up).
+func listenerHandoverAddr(pid int) *net.UnixAddr {
+	return &net.UnixAddr{Name: fmt.Sprintf("@gop-listeners-%d", pid), Net: "unix"}
+}
+
+func (a *App) serveListenerHandover() {
+	if len(a.listeners) == 0 {
+		return
+	}
+	hl, err := net.ListenUnix("unix", listenerHandoverAddr(os.Getpid()))
+	if err != nil {
+		a.Errorf("Can't listen for listener handover - listeners won't survive graceful restart: %s", err.Error())
+		return
+	}
+	for {
+		conn, err := hl.AcceptUnix()
+		if err != nil {
+			a.Errorf("Listener handover accept failed: %s", err.Error())
+			return
+		}
+		err = a.handOverListeners(conn)
+		if err != nil {
+			a.Errorf("Listener handover failed: %s", err.Error())
+		}
+		conn.Close()
+	}
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+func (a *App) handOverListeners(conn *net.UnixConn) error {
+	// Only to another process of ours
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if credErr != nil {
+		return credErr
+	}
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("refusing handover to uid %d", cred.Uid)
+	}
+
+	names := make([]string, 0, len(a.listeners))
+	fds := make([]int, 0, len(a.listeners))
+	for _, ln := range a.listeners {
+		f, err := ln.l.(filer).File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		names = append(names, ln.name)
+		fds = append(fds, int(f.Fd()))
+	}
+	payload, _ := json.Marshal(names)
+	a.Info("Handing listeners %v to pid %d", names, cred.Pid)
+	_, _, err = conn.WriteMsgUnix(payload, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+func (a *App) inheritListeners(ppid int) (map[string]net.Listener, error) {
+	conn, err := net.DialUnix("unix", nil, listenerHandoverAddr(ppid))
+	if err != nil {
+		// Parent had no extra listeners
+		return nil, nil
+	}
+	defer conn.Close()
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(256*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = json.Unmarshal(buf[:n], &names)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, fmt.Errorf("bad control message: %v", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != len(names) {
+		return nil, fmt.Errorf("got %d fds for %d listeners", len(fds), len(names))
+	}
+	inherited := make(map[string]net.Listener)
+	for i, name := range names {
+		f := os.NewFile(uintptr(fds[i]), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %s", name, err.Error())
+		}
+		inherited[name] = l
+	}
+	return inherited, nil
+}
@@ -15,5 +15,7 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	if err != nil {
 		a.Fatalln(err)
 	}
+	a.openListeners(nil)
+	a.serveListeners()
 	a.Serve(l)
 }
@@ -1,20 +1,22 @@
 /*
-	GOP "Go in Production" is an attempt to provide a useful set of services for running
-	(primarily http) applications in production service.
-
-	This includes:
-		- configuration
-		- logging
-		- statsd integration
-		- signal handling
-		- resource management
-		- basic web framework
+GOP "Go in Production" is an attempt to provide a useful set of services for running
+(primarily http) applications in production service.
+
+This includes:
+  - configuration
+  - logging
+  - statsd integration
+  - signal handling
+  - resource management
+  - basic web framework
 */
 package gop
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
-	"github.com/gorilla/context"
+	"github.com/cocoonlife/timber"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"os"
@@ -25,6 +27,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -54,8 +58,29 @@ type App struct {
 	totalReqs                int
 	doingGraceful            bool
 	accessLog                *os.File
+	auditLog                 *os.File
+	auditLock                sync.Mutex
 	suppressedAccessLogLines int
 	logDir                   string
+	tracer                   *tracer
+	slo                      *sloTracker
+	appGauges                []appGauge
+	appGaugesLock            sync.Mutex
+	middleware               []Middleware
+	encoders                 []registeredEncoder
+	errorRenderer            ErrorRenderer
+	limiters                 *concurrencyLimiters
+	rateLimiter              *rateLimiter
+	compressors              map[string]Compressor
+	certs                    *certStore
+	certsOnce                sync.Once
+	reqLogger                *timber.Timber
+	reqLoggerIndex           int
+	listeners                []*listener
+	listenerRouters          map[string]*mux.Router
+	webSockets               map[*WSConn]bool
+	webSocketsLock           sync.Mutex
+	trustedProxyNets         atomic.Pointer[[]*net.IPNet]
 }
 
 // The function signature your http handlers need.
@@ -67,13 +92,32 @@ type Req struct {
 	common
 
 	id           int
+	requestID    string
 	startTime    time.Time
 	app          *App
 	R            *http.Request
 	RealRemoteIP string
+	ProxyChain   []string // addresses from the client through any proxies to us
 	IsHTTPS      bool
+	Peer         *PeerIdentity // the verified client cert identity, with mutual TLS
 	W            *responseWriter
 	CanBeSlow    bool //set this to true to suppress the "Slow Request" warning
+	routeName    string
+	span         *Span
+	ctx          context.Context
+	cancel       context.CancelFunc
+	timeout      time.Duration
+	kind         atomic.Value // "websocket" or "sse" for long-lived requests
+	stream       *SSEStream
+}
+
+// "http" for ordinary requests, otherwise "websocket" or "sse"
+func (g *Req) Kind() string {
+	kind, _ := g.kind.Load().(string)
+	if kind == "" {
+		return "http"
+	}
+	return kind
 }
 
 // Return one of these from a handler to control the error response
@@ -81,6 +125,12 @@ type Req struct {
 type HTTPError struct {
 	Code int
 	Body string
+	// Optional machine-readable code, e.g. "user_not_found", and extra data for the client.
+	// These are included in structured (error_format = problem_json) error responses.
+	ErrorCode string
+	Details   interface{}
+	// Set with WithHeader. A pointer, so that HTTPErrors stay comparable (err == ErrNotFound)
+	headers *http.Header
 }
 
 // To satisfy the interface only
@@ -88,11 +138,61 @@ func (h HTTPError) Error() string {
 	return fmt.Sprintf("HTTP Error [%d] - %s", h.Code, h.Body)
 }
 func (h HTTPError) Write(w *responseWriter) {
+	h.writeHeaders(w)
 	w.WriteHeader(h.Code)
 	w.Write([]byte(h.Body))
 	w.Write([]byte("\r\n"))
 }
 
+// Copy of the error with an extra response header, e.g.
+//
+//	return gop.HTTPError{Code: 503, Body: "Busy"}.WithHeader("Retry-After", "10")
+func (h HTTPError) WithHeader(key, value string) HTTPError {
+	headers := make(http.Header)
+	if h.headers != nil {
+		for k, v := range *h.headers {
+			headers[k] = append([]string{}, v...)
+		}
+	}
+	headers.Add(key, value)
+	h.headers = &headers
+	return h
+}
+
+// Copy of the error with a machine-readable error code
+func (h HTTPError) WithErrorCode(errorCode string) HTTPError {
+	h.ErrorCode = errorCode
+	return h
+}
+
+// Copy of the error with extra details for the client
+func (h HTTPError) WithDetails(details interface{}) HTTPError {
+	h.Details = details
+	return h
+}
+
+// Extra response headers set with WithHeader
+func (h HTTPError) Header() http.Header {
+	if h.headers == nil {
+		return http.Header{}
+	}
+	return *h.headers
+}
+
+func (h HTTPError) writeHeaders(w *responseWriter) {
+	for k, v := range h.Header() {
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
+}
+
+// Errors which know how to send themselves to the client, e.g. HTTPError and BindError
+type responseError interface {
+	error
+	Write(w *responseWriter)
+}
+
 // Simple helpers for common HTTP error cases
 var ErrNotFound HTTPError = HTTPError{Code: http.StatusNotFound}
 var ErrBadRequest HTTPError = HTTPError{Code: http.StatusBadRequest}
@@ -121,8 +221,13 @@ func ServerError(body string) error {
 
 // Used for RPC to get a new request
 type wantReq struct {
-	r     *http.Request
-	reply chan *Req
+	r            *http.Request
+	w            http.ResponseWriter
+	routeTimeout time.Duration
+	routeName    string
+	requestID    string
+	span         *Span
+	reply        chan *Req
 }
 
 // Set up the application. Reads config. Panic if runtime environment is deficient.
@@ -138,6 +243,10 @@ func Init(projectName, appName string) *App {
 		doneReq:       make(chan *Req),
 		getReqs:       make(chan chan *Req),
 		startTime:     time.Now(),
+		encoders:      defaultEncoders(),
+		compressors:   defaultCompressors(),
+
+		listenerRouters: make(map[string]*mux.Router),
 	}
 
 	app.loadAppConfigFile()
@@ -150,12 +259,22 @@ func Init(projectName, appName string) *App {
 
 	app.initLogging()
 
+	app.initTrustedProxies()
+
 	maxProcs, _ := app.Cfg.GetInt("gop", "maxprocs", 4*runtime.NumCPU())
 	app.Debug("Setting maxprocs to %d\n", maxProcs)
 	runtime.GOMAXPROCS(maxProcs)
 
 	app.initStatsd()
 
+	app.initTracing()
+
+	app.initSLO()
+
+	app.initConcurrencyLimits()
+
+	app.initRateLimit()
+
 	return app
 }
 
@@ -208,38 +327,34 @@ func (a *App) requestMaker() {
 		select {
 		case wantReq := <-a.wantReq:
 			{
-				realRemoteIP := wantReq.r.RemoteAddr
-				isHTTPS := false
-				useXF, _ := a.Cfg.GetBool("gop", "use_xf_headers", false)
-				if useXF {
-					xff := wantReq.r.Header.Get("X-Forwarded-For")
-					if xff != "" {
-						ips := strings.Split(xff, ",")
-						for i, ip := range ips {
-							ips[i] = strings.TrimSpace(ip)
-						}
-						// The only trustworthy component is the *last* (and only if we
-						// are behind nginx or other proxy which is stripping x-f-f from incoming requests)
-						realRemoteIP = ips[len(ips)-1]
-					}
-					xfp := wantReq.r.Header.Get("X-Forwarded-Proto")
-					isHTTPS = strings.ToLower(xfp) == "https"
+				realRemoteIP, isHTTPS, proxyChain := a.clientAddress(wantReq.r)
+				if wantReq.r.TLS != nil {
+					isHTTPS = true
 				}
+				routeName := wantReq.routeName
 				req := Req{
 					common: common{
 						Logger:  a.Logger,
 						Cfg:     a.Cfg,
-						Stats:   a.Stats,
+						Stats:   a.Stats.forRoute(routeName),
 						Decoder: a.Decoder,
 					},
 
 					id:           nextReqId,
+					requestID:    wantReq.requestID,
 					app:          a,
 					startTime:    time.Now(),
 					R:            wantReq.r,
+					W:            &responseWriter{code: 200, ResponseWriter: wantReq.w, clientGone: wantReq.r.Context().Done()},
 					RealRemoteIP: realRemoteIP,
+					ProxyChain:   proxyChain,
 					IsHTTPS:      isHTTPS,
+					Peer:         peerIdentityFor(wantReq.r),
+					routeName:    routeName,
+					span:         wantReq.span,
+					timeout:      a.routeTimeout(routeName, wantReq.routeTimeout),
 				}
+				req.initContext()
 				openReqs[req.id] = &req
 				nextReqId++
 				a.totalReqs++
@@ -273,22 +388,61 @@ func (a *App) requestMaker() {
 	}
 }
 
-// Ask requestMaker for a request
-func (a *App) getReq(r *http.Request) *Req {
+// Ask requestMaker for a request. Anything that can be done here is, to keep it off
+// requestMaker's single goroutine.
+func (a *App) getReq(w http.ResponseWriter, r *http.Request, routeTimeout time.Duration) *Req {
 	reply := make(chan *Req)
-	a.wantReq <- &wantReq{r: r, reply: reply}
+	routeName := routeNameFor(r)
+	a.wantReq <- &wantReq{
+		r:            r,
+		w:            w,
+		routeTimeout: routeTimeout,
+		routeName:    routeName,
+		requestID:    a.requestIDFor(r),
+		span:         a.tracer.startServerSpan(r, routeName),
+		reply:        reply,
+	}
 	return <-reply
 }
 
-func (g *Req) finished() {
-	context.Clear(g.R) // Cleanup  gorilla stash
+// Name used for per-route stats. The mux route name if set, otherwise its path template
+func routeNameFor(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+	name := route.GetName()
+	if name == "" {
+		name, _ = route.GetPathTemplate()
+	}
+	// Needs to be a single statsd path component
+	name = strings.Trim(name, "/")
+	name = strings.NewReplacer("/", "_", ".", "_", ":", "_", " ", "_", "{", "", "}", "").Replace(name)
+	if name == "" {
+		name = "root"
+	}
+	return name
+}
 
+// The name of the route which is handling this request, as used for per-route stats
+func (g *Req) RouteName() string {
+	return g.routeName
+}
+
+func (g *Req) finished() {
 	reqDuration := time.Since(g.startTime)
 
 	g.app.WriteAccessLog(g, reqDuration)
 
+	g.endServerSpan()
+
+	g.app.slo.record(g.routeName, g.W.code, reqDuration, g.Kind() != "http")
+
 	codeStatsKey := fmt.Sprintf("http_status.%d", g.W.code)
 	g.app.Stats.Inc(codeStatsKey, 1)
+	g.app.Stats.Inc("http_proto."+protoStatName(g.R), 1)
+	g.app.Stats.Inc("http_bytes_uncompressed", int64(g.W.size))
+	g.app.Stats.Inc("http_bytes_sent", int64(g.W.wireSize))
 
 	slowReqSecs, _ := g.Cfg.GetFloat32("gop", "slow_req_secs", 10)
 	if reqDuration.Seconds() > float64(slowReqSecs) && !g.CanBeSlow {
@@ -383,6 +537,52 @@ func (g *Req) ParamDuration(key string) (time.Duration, error) {
 	return time.ParseDuration(s)
 }
 
+// An application value sampled by the watchdog
+type appGauge struct {
+	name           string
+	f              func() int64
+	limitConfigKey string // [gop] config key, empty if no limit
+}
+
+// Register a value to be sampled every watchdog_secs. It is included in the TICK log
+// line and sent as a statsd gauge. f must be safe to call from another goroutine.
+func (a *App) RegisterGauge(name string, f func() int64) {
+	a.RegisterLimit(name, f, "")
+}
+
+// As RegisterGauge, but also start a graceful restart if the value reaches the
+// (non-zero) limit set in the [gop] config section under limitConfigKey, in the same
+// way as numfds_limit.
+func (a *App) RegisterLimit(name string, f func() int64, limitConfigKey string) {
+	a.appGaugesLock.Lock()
+	defer a.appGaugesLock.Unlock()
+	a.appGauges = append(a.appGauges, appGauge{name: name, f: f, limitConfigKey: limitConfigKey})
+}
+
+func (a *App) checkAppGauges() string {
+	a.appGaugesLock.Lock()
+	gauges := make([]appGauge, len(a.appGauges))
+	copy(gauges, a.appGauges)
+	a.appGaugesLock.Unlock()
+
+	tickInfo := ""
+	for _, gauge := range gauges {
+		value := gauge.f()
+		tickInfo += fmt.Sprintf(",%s=%d", gauge.name, value)
+		a.Stats.Gauge(gauge.name, value)
+
+		if gauge.limitConfigKey == "" {
+			continue
+		}
+		limit, _ := a.Cfg.GetInt64("gop", gauge.limitConfigKey, 0)
+		if limit > 0 && value >= limit {
+			a.Errorf("%s LIMIT REACHED [%d >= %d] - starting graceful restart", strings.ToUpper(gauge.name), value, limit)
+			a.StartGracefulRestart(gauge.name + " limit reached")
+		}
+	}
+	return tickInfo
+}
+
 func (a *App) watchdog() {
 	repeat, _ := a.Cfg.GetInt("gop", "watchdog_secs", 300)
 	ticker := time.Tick(time.Second * time.Duration(repeat))
@@ -401,13 +601,16 @@ func (a *App) watchdog() {
 			// Continue without
 		}
 
-		a.Info("TICK: sys=%d,alloc=%d,fds=%d,current_req=%d,total_req=%d,goros=%d",
+		appGaugeInfo := a.checkAppGauges()
+
+		a.Info("TICK: sys=%d,alloc=%d,fds=%d,current_req=%d,total_req=%d,goros=%d%s",
 			sysMemBytes,
 			allocMemBytes,
 			numFDs,
 			a.currentReqs,
 			a.totalReqs,
-			numGoros)
+			numGoros,
+			appGaugeInfo)
 		a.Stats.Gauge("mem.sys", sysMemBytes)
 		a.Stats.Gauge("mem.alloc", allocMemBytes)
 		a.Stats.Gauge("numfds", numFDs)
@@ -440,36 +643,157 @@ func (a *App) watchdog() {
 	}
 }
 
-// Keep track of the status code and #bytes we write, so we can log and statsd on them
+// Keep track of the status code and #bytes we write, so we can log and statsd on them.
+// Once a request has hit its hard timeout, the handler's writes are discarded.
 type responseWriter struct {
 	http.ResponseWriter
-	size int
-	code int
+	size       int // bytes written by the handler
+	wireSize   int // bytes actually sent, after any compression
+	code       int
+	headerSent bool
+	timedOut   bool
+	done       bool         // the handler has finished and its response gone to the client
+	compress   *compression // nil unless the client accepts an encoding we have
+	clientGone <-chan struct{}
+	lock       sync.Mutex
 }
 
 // Satisfy the interface
 func (w *responseWriter) Header() http.Header {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		// Too late, nobody will see them
+		return http.Header{}
+	}
 	return w.ResponseWriter.Header()
 }
 
 func (w *responseWriter) Write(buf []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
 	w.size += len(buf)
-	return w.ResponseWriter.Write(buf)
+	if w.compress != nil {
+		return w.compress.write(w, buf)
+	}
+	w.sendHeader()
+	return w.wireWrite(buf)
+}
+
+// Satisfy http.Flusher, if the underlying writer can
+func (w *responseWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return
+	}
+	if w.compress != nil {
+		w.compress.flush(w)
+	}
+	w.sendHeader()
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
 }
 
+// Deprecated: use g.Context().Done()
 func (w *responseWriter) CloseNotify() <-chan bool {
-	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+	return closeNotify(w.ResponseWriter, w.clientGone)
+}
+
+// CloseNotify for w, which needn't support it: then we go by the client's request
+// context, which the server cancels when the connection goes.
+func closeNotify(w http.ResponseWriter, clientGone <-chan struct{}) <-chan bool {
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	notify := make(chan bool, 1)
+	if clientGone != nil {
+		go func() {
+			<-clientGone
+			notify <- true
+		}()
+	}
+	return notify
+}
+
+// For handlers which take over the connection. Nothing more goes through w afterwards.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.compress = nil
+		w.headerSent = true
+	}
+	return conn, rw, err
 }
 
 func (w *responseWriter) WriteHeader(code int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return
+	}
 	w.code = code
-	w.ResponseWriter.WriteHeader(code)
+	// If we might compress, the headers go once we know whether we are
+	if w.compress == nil || w.compress.decided {
+		w.sendHeader()
+	}
 }
 
 func (w *responseWriter) HasWritten() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 	return w.size > 0
 }
 
+// Must hold the lock
+func (w *responseWriter) sendHeader() {
+	if w.headerSent {
+		return
+	}
+	w.headerSent = true
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+// Write to the client, bypassing any compression. Must hold the lock.
+func (w *responseWriter) wireWrite(buf []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(buf)
+	w.wireSize += n
+	return n, err
+}
+
+// Called once the handler is done, to send anything still buffered
+func (w *responseWriter) finish() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return
+	}
+	if w.compress != nil {
+		w.compress.close(w)
+	}
+	if buffered, ok := w.ResponseWriter.(*timeoutWriter); ok {
+		buffered.commit()
+	}
+	w.done = true
+}
+
+func (w *responseWriter) isTimedOut() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.timedOut
+}
+
 func dealWithPanic(g *Req, showInResponse, showInLog, showAllInBacktrace bool, panicHTTPMessage string) {
 	r := recover()
 	if r == nil {
@@ -504,6 +828,12 @@ func dealWithPanic(g *Req, showInResponse, showInLog, showAllInBacktrace bool, p
 		httpErr.Body = panicHTTPMessage
 		if httpErr.Body == "" {
 			httpErr.Body = "PANIC: " + recoveredMessage
+			hide := g.app.configBool("gop", "hide_internal_errors", false)
+			if hide {
+				g.Errorf("PANIC: %s", recoveredMessage)
+				httpErr.Body = g.hiddenErrorMessage()
+				showInResponse = false
+			}
 		}
 	}
 
@@ -523,7 +853,7 @@ func dealWithPanic(g *Req, showInResponse, showInLog, showAllInBacktrace bool, p
 	if g.W.HasWritten() {
 		g.Errorf("PANIC after handler had written data: %s", httpErr.Body)
 	} else {
-		httpErr.Write(g.W)
+		g.sendError(httpErr)
 	}
 }
 
@@ -541,53 +871,126 @@ func getBackTrace(showAllGoros bool) []byte {
 }
 
 func (a *App) WrapHandler(h HandlerFunc, requiredParams ...string) http.HandlerFunc {
+	return a.wrapHandler(h, nil, requiredParams)
+}
+
+func (a *App) wrapHandler(h HandlerFunc, route *Route, requiredParams []string) http.HandlerFunc {
 	panicHTTPMessage, _ := a.Cfg.Get("gop", "panic_http_message", "")
 	showInLog, _ := a.Cfg.GetBool("gop", "panic_backtrace_to_log", false)
 	showInResponse, _ := a.Cfg.GetBool("gop", "panic_backtrace_in_response", false)
 	showAllInBacktrace, _ := a.Cfg.GetBool("gop", "panic_backtrace_all_goros", true)
 
-	// Wrap the handler, so we can do before/after logic
-	f := func(w http.ResponseWriter, r *http.Request) {
-		gopRequest := a.getReq(r)
+	run := func(gopRequest *Req) {
 		defer func() {
 			a.doneReq <- gopRequest
 		}()
-		gopWriter := responseWriter{code: 200, ResponseWriter: w}
-		gopRequest.W = &gopWriter
+		defer gopRequest.cancel()
+		gopWriter := gopRequest.W
+		defer gopWriter.finish()
+		defer gopRequest.closeStream()
+
+		// Panic handler. Before anything which might panic: timed requests run in their
+		// own goroutine, where an unrecovered panic would take the whole server down.
+		defer dealWithPanic(gopRequest, showInResponse, showInLog, showAllInBacktrace, panicHTTPMessage)
+
+		err := gopRequest.limitBody()
+		if err != nil {
+			gopRequest.sendError(err)
+			return
+		}
 
 		// TODO: remove this. We call in Params() on demand. Need to move current code
 		// over .Params() before we can remove this though.
-		err := r.ParseForm()
+		err = gopRequest.R.ParseForm()
+		if tooLarge := gopRequest.bodyError(err); tooLarge != nil {
+			gopRequest.sendError(tooLarge)
+			return
+		}
 		if err != nil {
 			a.Error("Failed to parse form: " + err.Error() + " (continuing)")
 			//            http.Error(&gopWriter, "Failed to parse form: " + err.Error(), http.StatusInternalServerError)
 			//          return
 		}
 
-		// Panic handler
-		defer dealWithPanic(gopRequest, showInResponse, showInLog, showAllInBacktrace, panicHTTPMessage)
-
-		err = gopRequest.checkRequiredParams(requiredParams)
-		// Only run handler if required args ok
-		if err == nil {
-			// Pass in the gop, for logging, cfg etc
-			err = h(gopRequest)
+		err = gopRequest.checkClientIdentity()
+		if err != nil {
+			gopRequest.sendError(err)
+			return
 		}
 
+		err = a.rateLimiter.check(gopRequest)
 		if err != nil {
-			httpErr, ok := err.(HTTPError)
-			if !ok {
-				httpErr = HTTPError{
-					Code: http.StatusInternalServerError,
-					Body: "Internal error: " + err.Error(),
-				}
+			gopRequest.sendError(err)
+			return
+		}
+
+		if route == nil || !route.longLived {
+			releaseConcurrency, err := a.acquireConcurrency(gopRequest)
+			if err != nil {
+				gopRequest.sendError(gopRequest.contextError(err))
+				return
+			}
+			defer releaseConcurrency()
+		}
+
+		handler := func(g *Req) error {
+			err := g.checkRequiredParams(requiredParams)
+			// Only run handler if required args ok
+			if err != nil {
+				return err
 			}
+			// Pass in the gop, for logging, cfg etc
+			return h(g)
+		}
+		// App-wide middleware goes outermost, so it runs before the required params check
+		err = WithMiddleware(handler, a.middleware...)(gopRequest)
+		err = gopRequest.contextError(err)
+
+		// If we've hit the hard timeout the client has already had a response
+		if err != nil && !gopWriter.isTimedOut() {
 			if gopWriter.HasWritten() {
 				// Ah. We have an error we'd like to send. But it's too late.
 				// Bad handler, no biscuit.
-				a.Errorf("Handler returned http error after writing data [%s] - discarding error", httpErr)
+				a.Errorf("Handler returned http error after writing data [%s] - discarding error", err)
 			} else {
-				httpErr.Write(&gopWriter)
+				gopRequest.sendError(err)
+			}
+		}
+	}
+
+	// Wrap the handler, so we can do before/after logic
+	f := func(w http.ResponseWriter, r *http.Request) {
+		routeTimeout := time.Duration(0)
+		if route != nil {
+			routeTimeout = route.timeout
+			if route.longLived && routeTimeout == 0 {
+				routeTimeout = -1
+			}
+		}
+		gopRequest := a.getReq(w, r, routeTimeout)
+		w.Header().Set(a.requestIDHeader(), gopRequest.requestID)
+		gopRequest.W.compress = a.negotiateCompression(r)
+
+		if gopRequest.timeout <= 0 {
+			run(gopRequest)
+			return
+		}
+
+		// Run the handler separately, so we can give up on it at the timeout
+		gopRequest.bufferForTimeout()
+		handlerDone := make(chan struct{})
+		go func() {
+			defer close(handlerDone)
+			run(gopRequest)
+		}()
+		select {
+		case <-handlerDone:
+		case <-gopRequest.ctx.Done():
+			if gopRequest.ctx.Err() == context.DeadlineExceeded {
+				gopRequest.hardTimeout()
+			} else {
+				// Client went away. Let the handler notice and tidy up.
+				<-handlerDone
 			}
 		}
 	}
@@ -612,12 +1015,38 @@ func (g *Req) checkRequiredParams(requiredParams []string) error {
 	return nil
 }
 
+// A route registered with HandleFunc. Embeds the gorilla route, so you can still
+// chain matchers, e.g. app.HandleFunc("/x", h).Timeout(time.Second).Methods("GET")
+type Route struct {
+	*mux.Route
+	timeout   time.Duration
+	longLived bool // websockets and streams: no app-wide timeout or concurrency limit
+}
+
+// Set a hard timeout for requests to this route. At the timeout the request context
+// is cancelled and, if the handler hasn't written anything yet, the client gets a 503.
+// A [request_timeouts] config entry for the route takes precedence.
+func (r *Route) Timeout(d time.Duration) *Route {
+	r.timeout = d
+	return r
+}
+
+// Mark a route as long-lived, e.g. one which streams with g.SSE(): it doesn't get
+// [gop] request_timeout (though Timeout and [request_timeouts] still apply) and
+// doesn't take a concurrency limit slot.
+func (r *Route) Streaming() *Route {
+	r.longLived = true
+	return r
+}
+
 // Register an http handler managed by gop.
 // We use Gorilla muxxer, since it is back-compatible and nice to use :-)
-func (a *App) HandleFunc(u string, h HandlerFunc, requiredParams ...string) *mux.Route {
-	gopHandler := a.WrapHandler(h, requiredParams...)
+func (a *App) HandleFunc(u string, h HandlerFunc, requiredParams ...string) *Route {
+	route := &Route{}
+	gopHandler := a.wrapHandler(h, route, requiredParams)
 
-	return a.GorillaRouter.HandleFunc(u, gopHandler)
+	route.Route = a.GorillaRouter.HandleFunc(u, gopHandler)
+	return route
 }
 
 func (a *App) Run() {
@@ -629,6 +1058,8 @@ func (a *App) Run() {
 
 	go a.watchdog()
 
+	go a.slo.reporter()
+
 	go a.requestMaker()
 
 	listenAddr, _ := a.Cfg.Get("gop", "listen_addr", ":http")
@@ -637,7 +1068,10 @@ func (a *App) Run() {
 }
 
 func (a *App) Serve(l net.Listener) {
-	http.Serve(l, a.GorillaRouter)
+	routes, _ := a.Cfg.Get("gop", "listen_routes", "all")
+	h2c, _ := a.Cfg.GetBool("gop", "h2c_enable", false)
+	proxyProto, _ := a.Cfg.GetBool("gop", "proxy_protocol", false)
+	a.serve(l, a.listenerHandler(a.listenerRouters[mainListener], routes), serveOptions{a.tlsEnabled(), h2c, proxyProto})
 }
 
 func getMemInfo() (int64, int64) {
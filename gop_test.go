@@ -0,0 +1,164 @@
+package gop
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+	"github.com/cocoonlife/timber"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+// An App set up as Init does, but with its config from cfg, no log or config files, and
+// stats sent to a local socket the test can read (see sentStats).
+func newTestApp(t *testing.T, cfg ConfigMap) *App {
+	if cfg == nil {
+		cfg = ConfigMap{}
+	}
+	a := &App{
+		common: common{
+			Decoder: schema.NewDecoder(),
+			Logger:  timber.Global,
+		},
+		AppName:         "app",
+		ProjectName:     "test",
+		GorillaRouter:   mux.NewRouter(),
+		wantReq:         make(chan *wantReq),
+		doneReq:         make(chan *Req),
+		getReqs:         make(chan chan *Req),
+		startTime:       time.Now(),
+		encoders:        defaultEncoders(),
+		compressors:     defaultCompressors(),
+		listenerRouters: make(map[string]*mux.Router),
+		logDir:          t.TempDir(),
+	}
+	a.Cfg = Config{
+		source:              cfg,
+		persistentOverrides: ConfigMap{},
+		transientOverrides:  ConfigMap{},
+		overrideFname:       a.logDir + "/app.conf.override",
+	}
+	a.Stats = StatsdClient{client: testStatsClient(t, a), rate: 1.0, app: a}
+	a.initTrustedProxies()
+	a.initTracing()
+	a.initSLO()
+	a.initConcurrencyLimits()
+	a.initRateLimit()
+	go a.requestMaker()
+	return a
+}
+
+var testStatsConns = struct {
+	sync.Mutex
+	m map[*App]*statsCatcher
+}{m: make(map[*App]*statsCatcher)}
+
+type statsCatcher struct {
+	sync.Mutex
+	lines []string
+}
+
+func testStatsClient(t *testing.T, a *App) *statsd.Client {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	catcher := &statsCatcher{}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			catcher.Lock()
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if line != "" {
+					catcher.lines = append(catcher.lines, strings.TrimPrefix(line, "test.app."))
+				}
+			}
+			catcher.Unlock()
+		}
+	}()
+	testStatsConns.Lock()
+	testStatsConns.m[a] = catcher
+	testStatsConns.Unlock()
+	client, err := statsd.New(conn.LocalAddr().String(), "test.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// The stats the app has sent, as "name:value|type", once they've arrived
+func sentStats(a *App) []string {
+	time.Sleep(50 * time.Millisecond)
+	testStatsConns.Lock()
+	catcher := testStatsConns.m[a]
+	testStatsConns.Unlock()
+	catcher.Lock()
+	defer catcher.Unlock()
+	return append([]string(nil), catcher.lines...)
+}
+
+func hasStat(a *App, prefix string) bool {
+	for _, line := range sentStats(a) {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run a request through the app's router
+func doRequest(a *App, method, url string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	a.GorillaRouter.ServeHTTP(w, r)
+	return w
+}
+
+func doRequestFrom(a *App, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.GorillaRouter.ServeHTTP(w, r)
+	return w
+}
+
+// Serve the app on a local port, returning its address
+func serveTestApp(t *testing.T, a *App) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go a.Serve(l)
+	return l.Addr().String()
+}
+
+// Wait for requestMaker to have retired finished requests, e.g. before changing config
+// (Config isn't safe to change while requests are being logged)
+func waitRetired(a *App) {
+	openRequests(a)
+}
+
+// The requests in /gop/status
+func openRequests(a *App) []*Req {
+	reqs := make([]*Req, 0)
+	reply := make(chan *Req)
+	a.getReqs <- reply
+	for g := range reply {
+		reqs = append(reqs, g)
+	}
+	return reqs
+}
@@ -13,11 +13,8 @@ import (
 
 var decoder = schema.NewDecoder() // Single-instance so struct info cached
 
+// enable_gop_urls is checked in adminAuth
 func gopHandler(g *Req) error {
-	enabled, _ := g.Cfg.GetBool("gop", "enable_gop_urls", false)
-	if !enabled {
-		return NotFound("Not enabled")
-	}
 	vars := mux.Vars(g.R)
 	switch vars["action"] {
 	case "status":
@@ -40,6 +37,10 @@ func gopHandler(g *Req) error {
 		{
 			return handleConfig(g)
 		}
+	case "slo":
+		{
+			return handleSLO(g)
+		}
 	default:
 		{
 			return ErrNotFound
@@ -145,12 +146,19 @@ func handleStack(g *Req) error {
 
 func handleStatus(g *Req) error {
 	type requestInfo struct {
-		Id       int
-		Method   string
-		Url      string
-		Duration float64
-		RemoteIP string
-		IsHTTPS  bool
+		Id        int
+		RequestID string
+		Method    string
+		Proto     string
+		Url       string
+		Duration  float64
+		RemoteIP  string
+		IsHTTPS   bool
+		Peer      string
+		Route     string
+		Kind      string
+		Counters  map[string]int64
+		TimedOut  bool
 	}
 	type requestStatus struct {
 		ProjectName   string
@@ -175,12 +183,19 @@ func handleStatus(g *Req) error {
 	for req := range reqChan {
 		reqDuration := time.Since(req.startTime)
 		info := requestInfo{
-			Id:       req.id,
-			Method:   req.R.Method,
-			Url:      req.R.URL.String(),
-			Duration: reqDuration.Seconds(),
-			RemoteIP: req.RealRemoteIP,
-			IsHTTPS:  req.IsHTTPS,
+			Id:        req.id,
+			RequestID: req.requestID,
+			Method:    req.R.Method,
+			Proto:     req.R.Proto,
+			Url:       req.R.URL.String(),
+			Duration:  reqDuration.Seconds(),
+			RemoteIP:  req.RealRemoteIP,
+			IsHTTPS:   req.IsHTTPS,
+			Peer:      peerName(req.Peer),
+			Route:     req.routeName,
+			Kind:      req.Kind(),
+			Counters:  req.Stats.Counts(),
+			TimedOut:  req.W.isTimedOut(),
 		}
 		status.RequestInfo = append(status.RequestInfo, info)
 	}
@@ -216,7 +231,8 @@ func handleTest(g *Req) error {
 }
 
 func (a *App) registerGopHandlers() {
-	a.HandleFunc("/gop/{action}", gopHandler)
-	a.HandleFunc("/gop/config/{section}", handleConfig)
-	a.HandleFunc("/gop/config/{section}/{key}", handleConfig)
+	r := a.adminRouter()
+	r.HandleFunc("/gop/{action}", gopHandler)
+	r.HandleFunc("/gop/config/{section}", handleConfig)
+	r.HandleFunc("/gop/config/{section}/{key}", handleConfig)
 }
@@ -0,0 +1,86 @@
+package gop
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func newProtoApp(t *testing.T, cfg map[string]string) *App {
+	a := newTestApp(t, ConfigMap{"gop": cfg})
+	a.HandleFunc("/proto", func(g *Req) error {
+		return g.SendText([]byte(g.R.Proto))
+	})
+	return a
+}
+
+// GET /proto, returning the protocol the client and server saw
+func getProto(t *testing.T, client *http.Client, url string) (string, string) {
+	resp, err := client.Get(url + "/proto")
+	if err != nil {
+		return "", err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.Proto, string(body)
+}
+
+func TestH2C(t *testing.T) {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	h2cClient := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	a := newProtoApp(t, map[string]string{"h2c_enable": "true"})
+	accessLog, err := os.Create(a.logDir + "/access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.accessLog = accessLog
+	addr := serveTestApp(t, a)
+
+	clientProto, serverProto := getProto(t, h2cClient, "http://"+addr)
+	test.Is(t, clientProto, "HTTP/2.0", "h2c response")
+	test.Is(t, serverProto, "HTTP/2.0", "h2c request")
+	_, serverProto = getProto(t, http.DefaultClient, "http://"+addr)
+	test.Is(t, serverProto, "HTTP/1.1", "HTTP/1.1 still served")
+
+	test.OK(t, hasStat(a, "http_proto.http2_0:1|c"), "HTTP/2 requests counted")
+	test.OK(t, hasStat(a, "http_proto.http1_1:1|c"), "HTTP/1.1 requests counted")
+	waitRetired(a)
+	logged, _ := os.ReadFile(a.logDir + "/access.log")
+	test.OK(t, strings.Contains(string(logged), "GET /proto HTTP/2.0"), "protocol in the access log")
+
+	// Off by default
+	addr = serveTestApp(t, newProtoApp(t, nil))
+	clientProto, _ = getProto(t, h2cClient, "http://"+addr)
+	test.OK(t, clientProto != "HTTP/2.0", "no h2c unless enabled")
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "server", newTestCert(t, "ca", nil)).write(t, dir, "server")
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	a := newProtoApp(t, map[string]string{"tls_cert_file": certFile, "tls_key_file": keyFile})
+	clientProto, serverProto := getProto(t, client, "https://"+serveTLS(t, a))
+	test.Is(t, clientProto, "HTTP/2.0", "HTTP/2 negotiated")
+	test.Is(t, serverProto, "HTTP/2.0", "HTTP/2 request")
+
+	a = newProtoApp(t, map[string]string{"tls_cert_file": certFile, "tls_key_file": keyFile, "http2_enable": "false"})
+	clientProto, serverProto = getProto(t, client, "https://"+serveTLS(t, a))
+	test.Is(t, clientProto, "HTTP/1.1", "HTTP/2 off")
+	test.Is(t, serverProto, "HTTP/1.1", "HTTP/1.1 request")
+
+	test.Is(t, a.httpServer(nil, false).HTTP2.MaxConcurrentStreams, 250, "default max streams")
+	a = newProtoApp(t, map[string]string{"http2_max_concurrent_streams": "10"})
+	test.Is(t, a.httpServer(nil, false).HTTP2.MaxConcurrentStreams, 10, "configured max streams")
+}
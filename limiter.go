@@ -0,0 +1,211 @@
+package gop
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Concurrency limiting. There is an app-wide limit ([gop] max_concurrent_requests) and
+// optional per-route limits ([concurrency_limits] <route> = N). Requests over a limit wait
+// in a bounded queue, and are shed with a 503 if the queue is full or they wait too long.
+// With concurrency_adaptive, each limit is adjusted AIMD-style: cut when requests are
+// slower than concurrency_latency_target, raised by one when we're at the limit and fast.
+
+type concurrencyLimiter struct {
+	sync.Mutex
+	app      *App
+	name     string
+	limit    int // current limit, <= the configured max
+	inFlight int
+	waiters  []chan struct{}
+}
+
+type concurrencyLimiters struct {
+	sync.Mutex
+	global *concurrencyLimiter
+	routes map[string]*concurrencyLimiter
+}
+
+func (a *App) initConcurrencyLimits() {
+	a.limiters = &concurrencyLimiters{
+		global: &concurrencyLimiter{app: a, name: "global"},
+		routes: make(map[string]*concurrencyLimiter),
+	}
+}
+
+func (ls *concurrencyLimiters) route(a *App, routeName string) *concurrencyLimiter {
+	ls.Lock()
+	defer ls.Unlock()
+	l, ok := ls.routes[routeName]
+	if !ok {
+		l = &concurrencyLimiter{app: a, name: "route." + routeName}
+		ls.routes[routeName] = l
+	}
+	return l
+}
+
+// Wait for a slot under the app-wide and route limits. Returns a func to call when
+// the request is done, or an error to send to the client.
+func (a *App) acquireConcurrency(g *Req) (func(), error) {
+	globalMax := a.configInt("gop", "max_concurrent_requests", 0)
+	routeMax := a.configInt("concurrency_limits", g.routeName, 0)
+
+	releases := make([]func(), 0, 2)
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	if globalMax > 0 {
+		r, err := a.limiters.global.acquire(g, globalMax)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	if routeMax > 0 {
+		r, err := a.limiters.route(a, g.routeName).acquire(g, routeMax)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+func (a *App) overloadedError() error {
+	retryAfter := a.configInt("gop", "concurrency_retry_after_secs", 1)
+	return HTTPError{
+		Code:      http.StatusServiceUnavailable,
+		Body:      "Server busy - try again later",
+		ErrorCode: "overloaded",
+	}.WithHeader("Retry-After", strconv.Itoa(retryAfter))
+}
+
+func (l *concurrencyLimiter) acquire(g *Req, max int) (func(), error) {
+	cfg := &l.app.Cfg
+	adaptive := l.app.configBool("gop", "concurrency_adaptive", false)
+	queueLen := l.app.configInt("gop", "concurrency_queue_len", 100)
+	queueTimeout, _ := cfg.GetDuration("gop", "concurrency_queue_timeout", time.Second)
+
+	l.Lock()
+	if !adaptive || l.limit <= 0 || l.limit > max {
+		l.limit = max
+	}
+	if l.inFlight < l.limit {
+		l.inFlight++
+		gauges := l.gauges()
+		l.Unlock()
+		l.sendGauges(gauges)
+		return l.releaser(adaptive, max), nil
+	}
+	if len(l.waiters) >= queueLen {
+		l.Unlock()
+		l.app.Stats.Inc("concurrency."+l.name+".shed", 1)
+		g.Errorf("Shedding request - %s concurrency limit %d reached and queue full", l.name, max)
+		return nil, l.app.overloadedError()
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	gauges := l.gauges()
+	l.Unlock()
+	l.sendGauges(gauges)
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return l.releaser(adaptive, max), nil
+	case <-timer.C:
+		l.app.Stats.Inc("concurrency."+l.name+".queue_timeouts", 1)
+		g.Errorf("Shedding request - waited %s for %s concurrency limit", queueTimeout, l.name)
+		err = l.app.overloadedError()
+	case <-g.ctx.Done():
+		err = g.ctx.Err()
+	}
+
+	l.Lock()
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			gauges = l.gauges()
+			l.Unlock()
+			l.sendGauges(gauges)
+			return nil, err
+		}
+	}
+	// We were handed a slot just as we gave up. Give it back.
+	l.inFlight--
+	l.wakeWaiters()
+	gauges = l.gauges()
+	l.Unlock()
+	l.sendGauges(gauges)
+	return nil, err
+}
+
+func (l *concurrencyLimiter) releaser(adaptive bool, max int) func() {
+	start := time.Now()
+	return func() {
+		latency := time.Since(start)
+		l.Lock()
+		if adaptive {
+			l.adapt(latency, max)
+		}
+		l.inFlight--
+		l.wakeWaiters()
+		gauges := l.gauges()
+		l.Unlock()
+		l.sendGauges(gauges)
+	}
+}
+
+// AIMD: back off multiplicatively when slow, grow additively when at the limit and fast
+func (l *concurrencyLimiter) adapt(latency time.Duration, max int) {
+	target, _ := l.app.Cfg.GetDuration("gop", "concurrency_latency_target", 500*time.Millisecond)
+	minLimit := l.app.configInt("gop", "concurrency_adaptive_min", 1)
+	if minLimit < 1 {
+		// A limit of 0 would never let another request through to raise it
+		minLimit = 1
+	}
+	if latency > target {
+		l.limit = int(float64(l.limit) * 0.9)
+	} else if l.inFlight >= l.limit {
+		l.limit++
+	}
+	if l.limit < minLimit {
+		l.limit = minLimit
+	}
+	if l.limit > max {
+		l.limit = max
+	}
+}
+
+// Hand free slots to waiters, oldest first. Must hold the lock.
+func (l *concurrencyLimiter) wakeWaiters() {
+	for l.inFlight < l.limit && len(l.waiters) > 0 {
+		ready := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.inFlight++
+		close(ready)
+	}
+}
+
+type limiterGauges struct {
+	limit, inFlight, queued int
+}
+
+// Must hold the lock
+func (l *concurrencyLimiter) gauges() limiterGauges {
+	return limiterGauges{limit: l.limit, inFlight: l.inFlight, queued: len(l.waiters)}
+}
+
+// Not under the lock, so that a slow statsd client doesn't hold up every request
+func (l *concurrencyLimiter) sendGauges(gauges limiterGauges) {
+	l.app.Stats.Gauge("concurrency."+l.name+".limit", int64(gauges.limit))
+	l.app.Stats.Gauge("concurrency."+l.name+".in_flight", int64(gauges.inFlight))
+	l.app.Stats.Gauge("concurrency."+l.name+".queued", int64(gauges.queued))
+}
@@ -0,0 +1,126 @@
+package gop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// An app whose /block requests run until released, and /quick requests don't
+func newLimitedApp(t *testing.T, cfg ConfigMap) (*App, chan bool, chan bool) {
+	a := newTestApp(t, cfg)
+	started := make(chan bool, 10)
+	release := make(chan bool)
+	a.HandleFunc("/block", func(g *Req) error {
+		started <- true
+		<-release
+		return g.SendText([]byte("done"))
+	})
+	a.HandleFunc("/quick", func(g *Req) error {
+		return g.SendText([]byte("done"))
+	})
+	a.HandleFunc("/stream", func(g *Req) error {
+		return g.SendText([]byte("done"))
+	}).Streaming()
+	return a, started, release
+}
+
+// Start a request in the background, returning where its response will arrive
+func goRequest(a *App, url string) chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- doRequest(a, "GET", url, nil, nil)
+	}()
+	return done
+}
+
+func queueLen(l *concurrencyLimiter) int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.waiters)
+}
+
+func TestConcurrencyLimitQueuesAndSheds(t *testing.T) {
+	a, started, release := newLimitedApp(t, ConfigMap{"gop": {
+		"max_concurrent_requests":      "1",
+		"concurrency_queue_len":        "1",
+		"concurrency_queue_timeout":    "5s",
+		"concurrency_retry_after_secs": "7",
+	}})
+	first := goRequest(a, "/block")
+	<-started
+	queued := goRequest(a, "/block")
+	for queueLen(a.limiters.global) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := doRequest(a, "GET", "/quick", nil, nil)
+	test.Is(t, w.Code, http.StatusServiceUnavailable, "shed when the queue is full")
+	test.Is(t, w.Header().Get("Retry-After"), "7", "Retry-After")
+	test.OK(t, hasStat(a, "concurrency.global.shed:1|c"), "shed counted")
+	test.Is(t, doRequest(a, "GET", "/stream", nil, nil).Code, http.StatusOK, "streams aren't limited")
+
+	release <- true
+	test.Is(t, (<-first).Code, http.StatusOK, "first request")
+	<-started
+	release <- true
+	test.Is(t, (<-queued).Code, http.StatusOK, "queued request runs once there's a slot")
+	test.Is(t, doRequest(a, "GET", "/quick", nil, nil).Code, http.StatusOK, "slots all given back")
+	test.OK(t, hasStat(a, "concurrency.global.in_flight:0|g"), "in flight gauge")
+	test.OK(t, hasStat(a, "concurrency.global.queued:1|g"), "queued gauge")
+}
+
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	a, started, release := newLimitedApp(t, ConfigMap{"gop": {
+		"max_concurrent_requests":   "1",
+		"concurrency_queue_timeout": "50ms",
+	}})
+	first := goRequest(a, "/block")
+	<-started
+	w := doRequest(a, "GET", "/quick", nil, nil)
+	test.Is(t, w.Code, http.StatusServiceUnavailable, "shed after waiting")
+	test.OK(t, hasStat(a, "concurrency.global.queue_timeouts:1|c"), "queue timeout counted")
+	release <- true
+	<-first
+}
+
+func TestConcurrencyRouteLimit(t *testing.T) {
+	a, started, release := newLimitedApp(t, ConfigMap{
+		"gop":                {"concurrency_queue_len": "0"},
+		"concurrency_limits": {"block": "1"},
+	})
+	first := goRequest(a, "/block")
+	<-started
+	test.Is(t, doRequest(a, "GET", "/block", nil, nil).Code, http.StatusServiceUnavailable, "route over its limit")
+	test.Is(t, doRequest(a, "GET", "/quick", nil, nil).Code, http.StatusOK, "other routes unaffected")
+	test.OK(t, hasStat(a, "concurrency.route.block.shed:1|c"), "route shed counted")
+	release <- true
+	<-first
+}
+
+func TestConcurrencyAdaptive(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {
+		"concurrency_latency_target": "100ms",
+		"concurrency_adaptive_min":   "2",
+	}})
+	l := &concurrencyLimiter{app: a, name: "global", limit: 10}
+	l.adapt(time.Second, 10)
+	test.Is(t, l.limit, 9, "cut when slow")
+	l.inFlight = 9
+	l.adapt(time.Millisecond, 10)
+	test.Is(t, l.limit, 10, "raised when fast at the limit")
+	l.adapt(time.Millisecond, 10)
+	test.Is(t, l.limit, 10, "never above the max")
+	l.inFlight = 1
+	l.limit = 2
+	l.adapt(time.Second, 10)
+	test.Is(t, l.limit, 2, "never below concurrency_adaptive_min")
+
+	a.Cfg.TransientOverride("gop", "concurrency_adaptive_min", "0")
+	l.limit = 1
+	l.adapt(time.Second, 10)
+	test.Is(t, l.limit, 1, "never below 1, whatever concurrency_adaptive_min says")
+}
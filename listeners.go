@@ -0,0 +1,181 @@
+package gop
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Extra listeners, configured in the [listeners] section as "<name>.<option>":
+//
+//	[listeners]
+//	admin.addr = 127.0.0.1:8081
+//	admin.routes = gop
+//	sock.net = unix
+//	sock.addr = /var/run/myapp.sock
+//
+// Options are net (default tcp), addr, tls (serve TLS with the app's certs), h2c,
+// proxy_protocol and routes, which says which of the app's routes the listener serves:
+// "all" (the default), "app" (all but /gop/*), "gop" (only /gop/*) or "none". Routes added
+// with App.ListenerRouter are served only on their listener. The main listener ([gop] listen_addr) is named "main",
+// and takes its routes from [gop] listen_routes. All listeners are handed over on
+// graceful restart.
+
+const mainListener = "main"
+
+type listener struct {
+	name   string
+	net    string
+	addr   string
+	l      net.Listener
+	router *mux.Router // routes only on this listener, or nil
+}
+
+// A Router whose routes are only served on the named listener. The app-wide middleware
+// still applies. Call before Run().
+func (a *App) ListenerRouter(name string, mw ...Middleware) *Router {
+	gorillaRouter, ok := a.listenerRouters[name]
+	if !ok {
+		gorillaRouter = mux.NewRouter()
+		a.listenerRouters[name] = gorillaRouter
+	}
+	return &Router{
+		app:           a,
+		middleware:    mw,
+		GorillaRouter: gorillaRouter,
+	}
+}
+
+// The names of the listeners in [listeners], sorted
+func (a *App) listenerNames() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, k := range a.Cfg.SectionKeys("listeners") {
+		dot := strings.IndexByte(k, '.')
+		if dot <= 0 || seen[k[:dot]] || k[:dot] == mainListener {
+			continue
+		}
+		seen[k[:dot]] = true
+		names = append(names, k[:dot])
+	}
+	if !seen[adminListener] && a.adminListenAddr() != "" {
+		names = append(names, adminListener)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A [listeners] option. The admin listener can also be set up with [gop] admin_listen_*.
+func (a *App) listenerOption(name, option, defaultValue string) string {
+	if name == adminListener {
+		defaultValue, _ = a.Cfg.Get("gop", "admin_listen_"+option, defaultValue)
+	}
+	v, _ := a.Cfg.Get("listeners", name+"."+option, defaultValue)
+	return v
+}
+
+// Open (or take over from our graceful parent) the [listeners]
+func (a *App) openListeners(inherited map[string]net.Listener) {
+	for _, name := range a.listenerNames() {
+		ln := &listener{name: name, router: a.listenerRouters[name]}
+		ln.net = a.listenerOption(name, "net", "tcp")
+		ln.addr = a.listenerOption(name, "addr", "")
+		if ln.addr == "" {
+			a.Fatalf("No addr for listener %s", name)
+		}
+		if l, ok := inherited[name]; ok {
+			a.Info("Listener %s taken over from graceful parent", name)
+			ln.l = l
+		} else {
+			a.Info("Starting listener %s on %s:%s", name, ln.net, ln.addr)
+			if ln.net == "unix" {
+				// Left over from a previous run - we never unlink it ourselves, as it
+				// may have been handed on to our graceful child
+				os.Remove(ln.addr)
+			}
+			l, err := net.Listen(ln.net, ln.addr)
+			if err != nil {
+				a.Fatalf("Can't start listener %s: %s", name, err.Error())
+			}
+			ln.l = l
+		}
+		if ul, ok := ln.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		a.listeners = append(a.listeners, ln)
+	}
+}
+
+func (a *App) serveListeners() {
+	for _, ln := range a.listeners {
+		useTLS, _ := strconv.ParseBool(a.listenerOption(ln.name, "tls", "false"))
+		defaultRoutes := "all"
+		if ln.name == adminListener {
+			// The /gop routes are on its own router
+			defaultRoutes = "none"
+		}
+		routes := a.listenerOption(ln.name, "routes", defaultRoutes)
+		h2c, _ := strconv.ParseBool(a.listenerOption(ln.name, "h2c", "false"))
+		proxyProto, _ := strconv.ParseBool(a.listenerOption(ln.name, "proxy_protocol", "false"))
+		go a.serve(ln.l, a.listenerHandler(ln.router, routes), serveOptions{useTLS, h2c, proxyProto})
+	}
+}
+
+func (a *App) closeListeners() {
+	for _, ln := range a.listeners {
+		ln.l.Close()
+	}
+}
+
+type serveOptions struct {
+	tls           bool
+	h2c           bool
+	proxyProtocol bool
+}
+
+func (a *App) serve(l net.Listener, handler http.Handler, opts serveOptions) {
+	if opts.proxyProtocol {
+		l = a.proxyProtoListener(l)
+	}
+	if opts.tls {
+		l = a.tlsListener(l)
+	}
+	a.httpServer(handler, opts.h2c).Serve(l)
+}
+
+func isGopPath(path string) bool {
+	return path == "/gop" || strings.HasPrefix(path, "/gop/")
+}
+
+// Serve the listener's own routes, then the subset of the app's routes it has
+func (a *App) listenerHandler(own *mux.Router, routes string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if own != nil && own.Match(r, &match) {
+			own.ServeHTTP(w, r)
+			return
+		}
+		allowed := false
+		switch routes {
+		case "all":
+			allowed = true
+		case "app":
+			allowed = !isGopPath(r.URL.Path)
+		case "gop":
+			allowed = isGopPath(r.URL.Path)
+		case "none":
+		default:
+			a.Errorf("Unknown listener routes [%s] - serving nothing", routes)
+		}
+		if !allowed {
+			http.NotFound(w, r)
+			return
+		}
+		a.GorillaRouter.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,126 @@
+package gop
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func listenerAddr(a *App, name string) string {
+	for _, ln := range a.listeners {
+		if ln.name == name {
+			return ln.l.Addr().String()
+		}
+	}
+	return ""
+}
+
+// GET url from a listener, returning the status and body
+func listenerGet(t *testing.T, network, addr, path string) (int, string) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://gop" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestListeners(t *testing.T) {
+	// Unix socket paths are short, so not under t.TempDir()
+	dir, err := os.MkdirTemp("", "gop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "app.sock")
+	// Left over from a previous run
+	os.WriteFile(sock, nil, 0600)
+
+	a := newTestApp(t, ConfigMap{
+		"gop": {
+			"enable_gop_urls":   "true",
+			"admin_listen_addr": "127.0.0.1:0",
+		},
+		"listeners": {
+			"api.addr":    "127.0.0.1:0",
+			"api.routes":  "app",
+			"sock.net":    "unix",
+			"sock.addr":   sock,
+			"sock.routes": "gop",
+		},
+	})
+	hello := func(g *Req) error {
+		return g.SendText([]byte("hello"))
+	}
+	a.HandleFunc("/hello", hello)
+	a.HandleFunc("/gop/hello", hello)
+	a.ListenerRouter("api").HandleFunc("/api_only", hello)
+	a.registerGopHandlers()
+
+	test.Is(t, a.listenerNames(), []string{"admin", "api", "sock"}, "listener names")
+	a.openListeners(nil)
+	t.Cleanup(a.closeListeners)
+	a.serveListeners()
+	mainAddr := serveTestApp(t, a)
+	api := listenerAddr(a, "api")
+	admin := listenerAddr(a, "admin")
+
+	cases := []struct {
+		network, addr, path string
+		code                int
+	}{
+		{"tcp", mainAddr, "/hello", http.StatusOK},
+		{"tcp", mainAddr, "/gop/hello", http.StatusOK},
+		{"tcp", mainAddr, "/api_only", http.StatusNotFound},
+		{"tcp", mainAddr, "/gop/stack", http.StatusNotFound},
+		{"tcp", api, "/hello", http.StatusOK},
+		{"tcp", api, "/api_only", http.StatusOK},
+		{"tcp", api, "/gop/hello", http.StatusNotFound},
+		{"unix", sock, "/gop/hello", http.StatusOK},
+		{"unix", sock, "/hello", http.StatusNotFound},
+		{"unix", sock, "/api_only", http.StatusNotFound},
+		{"tcp", admin, "/gop/stack", http.StatusOK},
+		{"tcp", admin, "/hello", http.StatusNotFound},
+		{"tcp", admin, "/gop/hello", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		code, _ := listenerGet(t, c.network, c.addr, c.path)
+		test.Is(t, code, c.code, c.network+" "+c.addr+c.path)
+	}
+
+	// Closing doesn't unlink the socket, which may have been handed to a graceful child
+	a.closeListeners()
+	_, err = os.Stat(sock)
+	test.ErrIs(t, err, nil, "socket left in place")
+}
+
+func TestListenersInherited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestApp(t, ConfigMap{"listeners": {"api.addr": "127.0.0.1:1"}})
+	a.HandleFunc("/hello", func(g *Req) error {
+		return g.SendText([]byte("hello"))
+	})
+	a.openListeners(map[string]net.Listener{"api": l})
+	t.Cleanup(a.closeListeners)
+	a.serveListeners()
+	test.Is(t, listenerAddr(a, "api"), l.Addr().String(), "listener taken over")
+	code, body := listenerGet(t, "tcp", l.Addr().String(), "/hello")
+	test.Is(t, code, http.StatusOK, "served on the inherited listener")
+	test.Is(t, body, "hello", "body")
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -64,6 +65,7 @@ func (a *App) makeConfigLogger() (timber.ConfigLogger, bool) {
 func (a *App) initLogging() {
 
 	configLogger, fellbackToCWD := a.makeConfigLogger()
+	configLogger.LogWriter = shareLogWriter(configLogger.LogWriter, 2)
 
 	// *Don't* create a NewTImber here. Logs are only flushed on Close() and if we
 	// have more than one timber, it's easy to only Close() one of them...
@@ -72,6 +74,12 @@ func (a *App) initLogging() {
 	a.Logger = l
 	a.loggerIndex = l.AddLogger(configLogger)
 
+	// ...except for Req logging, which has to be a frame deeper so that %S is the
+	// caller of g.Info() etc. rather than requestid.go. closeLogging closes it too.
+	a.reqLogger = timber.NewTimber()
+	a.reqLogger.FileDepth = l.FileDepth + 1
+	a.reqLoggerIndex = a.reqLogger.AddLogger(configLogger)
+
 	// Set up the default go logger to go here too, so 3rd party
 	// module logging plays nicely
 	log.SetFlags(0)
@@ -97,8 +105,36 @@ func (a *App) initLogging() {
 
 func (a *App) resetLogging() {
 	configLogger, _ := a.makeConfigLogger()
+	configLogger.LogWriter = shareLogWriter(configLogger.LogWriter, 2)
 	l := timber.Global
 	l.SetLogger(a.loggerIndex, configLogger)
+	a.reqLogger.SetLogger(a.reqLoggerIndex, configLogger)
+}
+
+// A LogWriter for both the global and Req timbers, closed when both have closed it
+type sharedLogWriter struct {
+	sync.Mutex
+	w     timber.LogWriter
+	users int
+}
+
+func shareLogWriter(w timber.LogWriter, users int) *sharedLogWriter {
+	return &sharedLogWriter{w: w, users: users}
+}
+
+func (s *sharedLogWriter) LogWrite(msg string) {
+	s.Lock()
+	defer s.Unlock()
+	s.w.LogWrite(msg)
+}
+
+func (s *sharedLogWriter) Close() {
+	s.Lock()
+	defer s.Unlock()
+	s.users--
+	if s.users == 0 {
+		s.w.Close()
+	}
 }
 
 func (a *App) closeLogging() {
@@ -108,6 +144,15 @@ func (a *App) closeLogging() {
 			a.Errorf("Error closing access log: %s", err.Error())
 		}
 	}
+	a.auditLock.Lock()
+	if a.auditLog != nil {
+		a.auditLog.Close()
+		a.auditLog = nil
+	}
+	a.auditLock.Unlock()
+	if a.reqLogger != nil {
+		a.reqLogger.Close()
+	}
 	timber.Close()
 }
 
@@ -129,13 +174,6 @@ func (a *App) WriteAccessLog(req *Req, dur time.Duration) {
 	/* ---
 	   gaiadev.leedsdev.net 0.022 192.168.111.1 - - [05/Feb/2014:13:39:22 +0000] "GET /bby/sso/login?next_url=https%3A%2F%2Fgaiadev.leedsdev.net%2F HTTP/1.1" 302 0 "-" "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:26.0) Gecko/20100101 Firefox/26.0"
 	   --- */
-	trimPort := func(s string) string {
-		colonOffset := strings.IndexByte(s, ':')
-		if colonOffset >= 0 {
-			s = s[:colonOffset]
-		}
-		return s
-	}
 	quote := func(s string) string {
 		return string(strconv.AppendQuote([]byte{}, s))
 	}
@@ -149,20 +187,27 @@ func (a *App) WriteAccessLog(req *Req, dur time.Duration) {
 	if uaLine == "" {
 		uaLine = "-"
 	}
+	user := "-"
+	if req.Peer != nil {
+		user = strings.Replace(req.Peer.String(), " ", "_", -1)
+	}
 	hostname, _ := os.Hostname()
-	logLine := fmt.Sprintf("%s %.3f %s %s %s %s %s %d %d %s %s\n",
+	logLine := fmt.Sprintf("%s %.3f %s %s %s %s %s %d %d %s %s %s %s %d\n",
 		hostname,
 		dur.Seconds(),
-		trimPort(req.RealRemoteIP),
+		stripPort(req.RealRemoteIP),
 		"-", // Ident <giggle>
-		"-", // user
+		user,
 		//		req.startTime.Format("[02/Jan/2006:15:04:05 -0700]"),
 		req.startTime.Format("["+time.RFC3339+"]"),
 		quote(reqFirstLine),
 		req.W.code,
 		req.W.size,
 		quote(referrerLine),
-		quote(uaLine))
+		quote(uaLine),
+		quote(req.Stats.countsSummary()),
+		req.requestID,
+		req.W.wireSize)
 	_, err := req.app.accessLog.WriteString(logLine)
 	if err != nil {
 		a.Errorf("Failed to write to access log: %s", err.Error())
@@ -0,0 +1,87 @@
+package gop
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Middleware wraps a HandlerFunc with shared before/after logic (auth, rate limiting, CORS...).
+// It runs inside the gop request lifecycle, so it gets the *Req, can return an HTTPError
+// instead of calling next, and any panic is handled as for the handler itself.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Wrap h in the given middleware. The first middleware is the outermost, i.e. runs first.
+// Use this for per-route middleware:
+//
+//	app.HandleFunc("/admin", gop.WithMiddleware(adminHandler, requireAuth))
+func WithMiddleware(h HandlerFunc, mw ...Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Add middleware which runs for every request handled by the app, including those
+// registered before the call. Call before Run().
+func (a *App) Use(mw ...Middleware) {
+	a.middleware = append(a.middleware, mw...)
+}
+
+// A group of routes sharing a path prefix and middleware
+type Router struct {
+	app        *App
+	parent     *Router
+	middleware []Middleware
+	// The underlying gorilla subrouter, if you need to add matchers
+	GorillaRouter *mux.Router
+}
+
+// Create a group of routes under pathPrefix which all run the given middleware
+// (after the app-wide middleware).
+func (a *App) Subrouter(pathPrefix string, mw ...Middleware) *Router {
+	return &Router{
+		app:           a,
+		middleware:    mw,
+		GorillaRouter: a.GorillaRouter.PathPrefix(pathPrefix).Subrouter(),
+	}
+}
+
+// Create a nested group of routes. Middleware from this router runs first.
+func (r *Router) Subrouter(pathPrefix string, mw ...Middleware) *Router {
+	return &Router{
+		app:           r.app,
+		parent:        r,
+		middleware:    mw,
+		GorillaRouter: r.GorillaRouter.PathPrefix(pathPrefix).Subrouter(),
+	}
+}
+
+// Add middleware for every route in this router (and nested routers), including
+// those registered before the call. Call before Run().
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Register an http handler managed by gop, under this router's path prefix.
+func (r *Router) HandleFunc(u string, h HandlerFunc, requiredParams ...string) *Route {
+	handler := func(g *Req) error {
+		err := g.checkRequiredParams(requiredParams)
+		if err != nil {
+			return err
+		}
+		return h(g)
+	}
+	// Look the middleware up per-request, so Use() applies to routes already registered
+	routed := func(g *Req) error {
+		return WithMiddleware(handler, r.allMiddleware()...)(g)
+	}
+	route := &Route{}
+	route.Route = r.GorillaRouter.HandleFunc(u, r.app.wrapHandler(routed, route, nil))
+	return route
+}
+
+func (r *Router) allMiddleware() []Middleware {
+	if r.parent == nil {
+		return r.middleware
+	}
+	return append(append([]Middleware{}, r.parent.allMiddleware()...), r.middleware...)
+}
@@ -0,0 +1,77 @@
+package gop
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// Middleware recording that it ran in the X-Order response header
+func orderMiddleware(name string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			g.W.Header().Add("X-Order", name)
+			return next(g)
+		}
+	}
+}
+
+func sendOrder(g *Req) error {
+	return g.SendText([]byte(strings.Join(g.W.Header().Values("X-Order"), ",")))
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.Use(orderMiddleware("app"))
+	a.HandleFunc("/plain", sendOrder)
+	api := a.Subrouter("/api", orderMiddleware("api"))
+	v1 := api.Subrouter("/v1", orderMiddleware("v1"))
+	v1.HandleFunc("/x", WithMiddleware(sendOrder, orderMiddleware("route1"), orderMiddleware("route2")), "id")
+
+	test.Is(t, doRequest(a, "GET", "/plain", nil, nil).Body.String(), "app", "app-wide")
+	test.Is(t, doRequest(a, "GET", "/api/v1/x?id=1", nil, nil).Body.String(), "app,api,v1,route1,route2", "outermost first")
+
+	// Use applies to routes already registered
+	api.Use(orderMiddleware("late"))
+	test.Is(t, doRequest(a, "GET", "/api/v1/x?id=1", nil, nil).Body.String(), "app,api,late,v1,route1,route2", "added later")
+
+	// Router middleware runs before the required params check, per-route middleware after
+	w := doRequest(a, "GET", "/api/v1/x", nil, nil)
+	test.Is(t, w.Code, http.StatusBadRequest, "missing param")
+	test.Is(t, w.Header().Values("X-Order"), []string{"app", "api", "late", "v1"}, "middleware run before the check")
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.Use(func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			switch g.R.FormValue("as") {
+			case "":
+				return HTTPError{Code: http.StatusForbidden, Body: "No"}
+			case "panic":
+				panic("boom")
+			}
+			return next(g)
+		}
+	})
+	ran := 0
+	a.HandleFunc("/x", func(g *Req) error {
+		ran++
+		return g.SendText([]byte("ok"))
+	})
+
+	w := doRequest(a, "GET", "/x", nil, nil)
+	test.Is(t, w.Code, http.StatusForbidden, "denied")
+	test.Is(t, ran, 0, "handler not run")
+
+	w = doRequest(a, "GET", "/x?as=panic", nil, nil)
+	test.Is(t, w.Code, http.StatusInternalServerError, "panic in middleware")
+	test.OK(t, strings.Contains(w.Body.String(), "boom"), "panic message")
+	test.Is(t, ran, 0, "handler not run after panic")
+
+	w = doRequest(a, "GET", "/x?as=alice", nil, nil)
+	test.Is(t, w.Body.String(), "ok", "allowed")
+	test.Is(t, ran, 1, "handler run")
+}
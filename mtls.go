@@ -0,0 +1,296 @@
+package gop
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Mutual TLS. Client certs are verified against tls_client_ca_file (and tls_crl_file, if
+// set) according to tls_client_auth. Both files are reloaded along with the server certs.
+// The verified identity is available as Req.Peer, and routes can be restricted to a list
+// of identities in the [client_identities] section.
+
+// The identity from a verified client certificate
+type PeerIdentity struct {
+	Subject        string
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	SPIFFEID       string // the spiffe:// URI SAN, if any
+	Certificate    *x509.Certificate
+}
+
+func newPeerIdentity(cert *x509.Certificate) *PeerIdentity {
+	p := &PeerIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Certificate:    cert,
+	}
+	for _, u := range cert.URIs {
+		p.URIs = append(p.URIs, u.String())
+		if u.Scheme == "spiffe" && p.SPIFFEID == "" {
+			p.SPIFFEID = u.String()
+		}
+	}
+	return p
+}
+
+// The verified client identity, or nil if the client didn't present a cert we verified
+func peerIdentityFor(r *http.Request) *PeerIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return newPeerIdentity(r.TLS.VerifiedChains[0][0])
+}
+
+// The best single name for the peer: SPIFFE ID, then CN, then first SAN
+func (p *PeerIdentity) String() string {
+	switch {
+	case p.SPIFFEID != "":
+		return p.SPIFFEID
+	case p.CommonName != "":
+		return p.CommonName
+	case len(p.DNSNames) > 0:
+		return p.DNSNames[0]
+	case len(p.URIs) > 0:
+		return p.URIs[0]
+	}
+	return p.Subject
+}
+
+func peerName(p *PeerIdentity) string {
+	if p == nil {
+		return ""
+	}
+	return p.String()
+}
+
+// Does an allowlist entry match us? Entries are compared with the CN, the SANs and the
+// full subject; a trailing * matches any suffix.
+func (p *PeerIdentity) Matches(pattern string) bool {
+	names := []string{p.Subject, p.CommonName}
+	names = append(names, p.DNSNames...)
+	names = append(names, p.EmailAddresses...)
+	names = append(names, p.URIs...)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify_if_given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown tls_client_auth [%s]", mode)
+}
+
+// The revoked client certs from tls_crl_file. revoked is nil without a CRL.
+type crlInfo struct {
+	revoked    map[string]bool
+	nextUpdate time.Time // the soonest NextUpdate of the CRLs, zero if none say
+}
+
+// Load the client CA bundle and CRL, adding them to the files watched for changes
+func (cs *certStore) loadClientAuth(modTimes map[string]time.Time) (*x509.CertPool, crlInfo, error) {
+	caFile, _ := cs.app.Cfg.Get("gop", "tls_client_ca_file", "")
+	crlFile, _ := cs.app.Cfg.Get("gop", "tls_crl_file", "")
+	if caFile == "" {
+		return nil, crlInfo{}, nil
+	}
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, crlInfo{}, fmt.Errorf("can't read tls_client_ca_file: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, crlInfo{}, fmt.Errorf("no certs found in tls_client_ca_file %s", caFile)
+	}
+	modTimes[caFile] = fileModTime(caFile)
+
+	var crl crlInfo
+	if crlFile != "" {
+		crl, err = loadCRL(crlFile, parseCerts(caPEM), time.Now())
+		if err != nil {
+			return nil, crlInfo{}, err
+		}
+		cs.app.Info("Loaded CRL %s with %d revoked certs", crlFile, len(crl.revoked))
+		modTimes[crlFile] = fileModTime(crlFile)
+	}
+	return pool, crl, nil
+}
+
+func parseCerts(pemData []byte) []*x509.Certificate {
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// Revoked certs, keyed by issuer and serial. The file may be PEM or DER, and hold
+// several CRLs (one per issuing CA). Each must be signed by one of the CAs and not
+// be past its NextUpdate.
+func loadCRL(crlFile string, cas []*x509.Certificate, now time.Time) (crlInfo, error) {
+	data, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return crlInfo{}, fmt.Errorf("can't read tls_crl_file: %s", err.Error())
+	}
+	ders := make([][]byte, 0)
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	info := crlInfo{revoked: make(map[string]bool)}
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return crlInfo{}, fmt.Errorf("can't parse tls_crl_file %s: %s", crlFile, err.Error())
+		}
+		if !crlSignedByOneOf(crl, cas) {
+			return crlInfo{}, fmt.Errorf("CRL from %s in tls_crl_file %s isn't signed by a tls_client_ca_file CA", crl.Issuer, crlFile)
+		}
+		if !crl.NextUpdate.IsZero() {
+			if now.After(crl.NextUpdate) {
+				return crlInfo{}, fmt.Errorf("CRL from %s in tls_crl_file %s expired at %s", crl.Issuer, crlFile, crl.NextUpdate)
+			}
+			if info.nextUpdate.IsZero() || crl.NextUpdate.Before(info.nextUpdate) {
+				info.nextUpdate = crl.NextUpdate
+			}
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			info.revoked[revocationKey(crl.RawIssuer, entry.SerialNumber.String())] = true
+		}
+	}
+	return info, nil
+}
+
+func crlSignedByOneOf(crl *x509.RevocationList, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "|" + serial
+}
+
+// tls.Config.VerifyPeerCertificate, run after the normal chain verification
+func (cs *certStore) checkRevoked(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	cs.RLock()
+	crl := cs.crl
+	cs.RUnlock()
+	if crl.revoked == nil {
+		return nil
+	}
+	// An out of date list can't be trusted to have every revoked cert, so nobody gets in
+	// until a new one is loaded
+	if !crl.nextUpdate.IsZero() && time.Now().After(crl.nextUpdate) {
+		cs.app.Stats.Inc("tls.expired_crl", 1)
+		cs.app.Errorf("tls_crl_file expired at %s - rejecting client certs until it is replaced", crl.nextUpdate)
+		return fmt.Errorf("CRL expired at %s", crl.nextUpdate)
+	}
+	revoked := crl.revoked
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())] {
+				cs.app.Stats.Inc("tls.revoked_client_certs", 1)
+				return fmt.Errorf("client certificate %s (serial %s) is revoked", cert.Subject, cert.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// Per handshake, so changes to tls_client_auth and reloaded CAs apply to new connections
+func (cs *certStore) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		cs.RLock()
+		clientCAs := cs.clientCAs
+		cs.RUnlock()
+		if clientCAs == nil {
+			return nil, nil
+		}
+		mode, _ := cs.app.Cfg.Get("gop", "tls_client_auth", "verify_if_given")
+		authType, err := clientAuthType(mode)
+		if err != nil {
+			cs.app.Error(err.Error())
+			return nil, err
+		}
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.ClientAuth = authType
+		config.ClientCAs = clientCAs
+		config.VerifyPeerCertificate = cs.checkRevoked
+		return config, nil
+	}
+}
+
+// Enforce the route's [client_identities] allowlist, if it has one
+func (g *Req) checkClientIdentity() error {
+	allowed, found := g.Cfg.GetList("client_identities", g.routeName, nil)
+	if !found {
+		return nil
+	}
+	if g.Peer == nil {
+		g.Stats.Inc("client_identity.rejected", 1)
+		return HTTPError{Code: http.StatusForbidden, Body: "Client certificate required", ErrorCode: "client_cert_required"}
+	}
+	for _, pattern := range allowed {
+		if pattern != "" && g.Peer.Matches(pattern) {
+			return nil
+		}
+	}
+	g.Stats.Inc("client_identity.rejected", 1)
+	g.Errorf("Client [%s] not allowed on route %s", g.Peer, g.routeName)
+	return HTTPError{Code: http.StatusForbidden, Body: "Client not allowed", ErrorCode: "client_not_allowed"}
+}
@@ -0,0 +1,171 @@
+package gop
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// A PEM CRL from ca revoking the given certs
+func newTestCRL(t *testing.T, ca *testCert, nextUpdate time.Time, revoked ...*testCert) []byte {
+	list := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: nextUpdate,
+	}
+	for _, c := range revoked {
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   c.cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+type mtlsFixture struct {
+	ca, good, revoked, stranger *testCert
+	addr                        string
+}
+
+// Serve /whoami over mutual TLS, with a CRL revoking one client cert
+func newMTLSFixture(t *testing.T, cfg map[string]string) *mtlsFixture {
+	dir := t.TempDir()
+	f := &mtlsFixture{ca: newTestCert(t, "ca", nil)}
+	f.good = newTestCert(t, "good", f.ca)
+	f.revoked = newTestCert(t, "revoked", f.ca)
+	f.stranger = newTestCert(t, "stranger", newTestCert(t, "other ca", nil))
+	certFile, keyFile := newTestCert(t, "server", f.ca).write(t, dir, "server")
+	os.WriteFile(dir+"/ca.pem", f.ca.certPEM, 0600)
+	os.WriteFile(dir+"/crl.pem", newTestCRL(t, f.ca, time.Now().Add(time.Hour), f.revoked), 0600)
+
+	gopCfg := map[string]string{
+		"tls_cert_file":      certFile,
+		"tls_key_file":       keyFile,
+		"tls_client_ca_file": dir + "/ca.pem",
+		"tls_crl_file":       dir + "/crl.pem",
+	}
+	for k, v := range cfg {
+		gopCfg[k] = v
+	}
+	a := newTestApp(t, ConfigMap{"gop": gopCfg})
+	a.HandleFunc("/whoami", func(g *Req) error {
+		return g.SendText([]byte(peerName(g.Peer)))
+	})
+	f.addr = serveTLS(t, a)
+	return f
+}
+
+// GET /whoami, presenting cert (if not nil). Returns the body, or the error.
+func (f *mtlsFixture) whoami(cert *testCert) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert.certPEM, cert.keyPEM)
+		if err != nil {
+			return "", err
+		}
+		// Even if it isn't from a CA the server asks for
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &pair, nil
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get("https://" + f.addr + "/whoami")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestMTLSRequired(t *testing.T) {
+	f := newMTLSFixture(t, map[string]string{"tls_client_auth": "require"})
+
+	peer, err := f.whoami(f.good)
+	test.ErrIs(t, err, nil, "valid client cert")
+	test.Is(t, peer, "good", "peer identity")
+
+	_, err = f.whoami(nil)
+	test.ErrNotNil(t, err, "no client cert")
+	_, err = f.whoami(f.revoked)
+	test.ErrNotNil(t, err, "revoked client cert")
+	_, err = f.whoami(f.stranger)
+	test.ErrNotNil(t, err, "client cert from another CA")
+}
+
+func TestMTLSOptional(t *testing.T) {
+	f := newMTLSFixture(t, map[string]string{"tls_client_auth": "verify_if_given"})
+
+	peer, err := f.whoami(nil)
+	test.ErrIs(t, err, nil, "no client cert")
+	test.Is(t, peer, "", "no peer identity")
+
+	peer, err = f.whoami(f.good)
+	test.ErrIs(t, err, nil, "valid client cert")
+	test.Is(t, peer, "good", "peer identity")
+
+	_, err = f.whoami(f.revoked)
+	test.ErrNotNil(t, err, "revoked client cert")
+	_, err = f.whoami(f.stranger)
+	test.ErrNotNil(t, err, "client cert from another CA")
+}
+
+func TestLoadCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	impostor := newTestCert(t, "ca", nil) // same name, different key
+	revoked := newTestCert(t, "revoked", ca)
+	write := func(name string, data []byte) string {
+		os.WriteFile(dir+"/"+name, data, 0600)
+		return dir + "/" + name
+	}
+	cas := []*x509.Certificate{ca.cert}
+	now := time.Now()
+
+	crl, err := loadCRL(write("good.pem", newTestCRL(t, ca, now.Add(time.Hour), revoked)), cas, now)
+	test.ErrIs(t, err, nil, "valid CRL")
+	test.OK(t, crl.revoked[revocationKey(revoked.cert.RawIssuer, revoked.cert.SerialNumber.String())], "revoked cert listed")
+	test.Is(t, len(crl.revoked), 1, "revoked certs")
+
+	block, _ := pem.Decode(newTestCRL(t, ca, now.Add(time.Hour), revoked))
+	_, err = loadCRL(write("good.der", block.Bytes), cas, now)
+	test.ErrIs(t, err, nil, "DER CRL")
+
+	_, err = loadCRL(write("forged.pem", newTestCRL(t, impostor, now.Add(time.Hour), revoked)), cas, now)
+	test.ErrNotNil(t, err, "CRL not signed by the CA")
+
+	_, err = loadCRL(write("expired.pem", newTestCRL(t, ca, now.Add(-time.Second), revoked)), cas, now)
+	test.ErrNotNil(t, err, "expired CRL")
+
+	_, err = loadCRL(write("junk.pem", []byte("junk")), cas, now)
+	test.ErrNotNil(t, err, "junk CRL")
+}
+
+func TestExpiredCRLRejectsClients(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	good := newTestCert(t, "good", ca)
+	cs := &certStore{app: newTestApp(t, nil)}
+	chains := [][]*x509.Certificate{{good.cert, ca.cert}}
+
+	cs.crl = crlInfo{revoked: map[string]bool{}, nextUpdate: time.Now().Add(time.Hour)}
+	test.ErrIs(t, cs.checkRevoked(nil, chains), nil, "current CRL")
+	cs.crl.nextUpdate = time.Now().Add(-time.Second)
+	test.ErrNotNil(t, cs.checkRevoked(nil, chains), "expired CRL")
+	cs.crl = crlInfo{}
+	test.ErrIs(t, cs.checkRevoked(nil, chains), nil, "no CRL")
+}
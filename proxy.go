@@ -0,0 +1,194 @@
+package gop
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Finding the real client behind proxies. Forwarding headers are only believed when they
+// come from a proxy in trusted_proxies. The hops they list are walked right to left,
+// skipping trusted proxies, and the first untrusted hop is the client. Headers are tried
+// in forwarded_headers order: the RFC 7239 Forwarded header, X-Forwarded-For, X-Real-IP.
+//
+// With use_xf_headers but no trusted_proxies we keep the old behaviour: the last
+// X-Forwarded-For entry is the client, whoever sent it.
+
+// trusted_proxies is parsed at startup and again whenever the config changes, not on
+// every request
+func (a *App) initTrustedProxies() {
+	a.loadTrustedProxies()
+	a.Cfg.AddOnChangeCallback(func(cfg *Config) { a.loadTrustedProxies() })
+}
+
+func (a *App) loadTrustedProxies() {
+	nets := a.parseTrustedProxies()
+	a.trustedProxyNets.Store(&nets)
+}
+
+func (a *App) trustedProxies() []*net.IPNet {
+	nets := a.trustedProxyNets.Load()
+	if nets == nil {
+		return nil
+	}
+	return *nets
+}
+
+func (a *App) parseTrustedProxies() []*net.IPNet {
+	cidrs, _ := a.Cfg.GetList("gop", "trusted_proxies", nil)
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			// A single address
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			a.Errorf("Bad trusted_proxies entry [%s]: %s", cidr, err.Error())
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(stripPort(addr))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split on sep, except inside double quotes
+func splitQuoted(s string, sep byte) []string {
+	parts := make([]string, 0)
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// The for= and proto= of each element of RFC 7239 Forwarded headers, first hop first
+func parseForwarded(headers []string) (fors []string, protos []string) {
+	for _, header := range headers {
+		for _, element := range splitQuoted(header, ',') {
+			forValue, proto := "", ""
+			for _, pair := range splitQuoted(element, ';') {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:eq]))
+				value := strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+				switch key {
+				case "for":
+					forValue = value
+				case "proto":
+					proto = value
+				}
+			}
+			if forValue != "" {
+				fors = append(fors, forValue)
+				protos = append(protos, proto)
+			}
+		}
+	}
+	return fors, protos
+}
+
+func splitList(headers []string) []string {
+	items := make([]string, 0)
+	for _, header := range headers {
+		for _, item := range strings.Split(header, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// Who the client really is, whether they came to our proxy over https, and the chain of
+// addresses from the client to us (including our peer)
+func (a *App) clientAddress(r *http.Request) (realRemoteIP string, isHTTPS bool, chain []string) {
+	peer := r.RemoteAddr
+	trusted := a.trustedProxies()
+	if len(trusted) == 0 {
+		useXF := a.configBool("gop", "use_xf_headers", false)
+		if !useXF {
+			return peer, false, []string{peer}
+		}
+		hops := splitList(r.Header["X-Forwarded-For"])
+		isHTTPS = strings.ToLower(r.Header.Get("X-Forwarded-Proto")) == "https"
+		if len(hops) == 0 {
+			return peer, isHTTPS, []string{peer}
+		}
+		// The only trustworthy component is the *last* (and only if we
+		// are behind nginx or other proxy which is stripping x-f-f from incoming requests)
+		return hops[len(hops)-1], isHTTPS, append(hops, peer)
+	}
+	if !isTrusted(peer, trusted) {
+		return peer, false, []string{peer}
+	}
+
+	var hops, protos []string
+	headers, _ := a.Cfg.GetList("gop", "forwarded_headers", []string{"forwarded", "x-forwarded-for", "x-real-ip"})
+	for _, header := range headers {
+		switch strings.ToLower(header) {
+		case "forwarded":
+			hops, protos = parseForwarded(r.Header["Forwarded"])
+		case "x-forwarded-for":
+			hops = splitList(r.Header["X-Forwarded-For"])
+			protos = nil
+		case "x-real-ip":
+			hops = splitList(r.Header["X-Real-Ip"])
+			protos = nil
+		default:
+			a.Errorf("Unknown forwarded_headers entry [%s]", header)
+		}
+		if len(hops) > 0 {
+			break
+		}
+	}
+	if len(hops) == 0 {
+		return peer, r.TLS != nil, []string{peer}
+	}
+
+	chain = append(hops, peer)
+	client := 0
+	for i := len(hops) - 1; i >= 0; i-- {
+		client = i
+		if !isTrusted(hops[i], trusted) {
+			break
+		}
+	}
+	if len(protos) > client && protos[client] != "" {
+		isHTTPS = strings.ToLower(protos[client]) == "https"
+	} else {
+		xfp := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+		isHTTPS = strings.ToLower(strings.TrimSpace(xfp)) == "https"
+	}
+	return stripPort(hops[client]), isHTTPS, chain
+}
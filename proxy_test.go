@@ -0,0 +1,84 @@
+package gop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestClientAddressTrustedProxies(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"trusted_proxies": "10.0.0.0/8, 192.0.2.1, 2001:db8::/32"}})
+	cases := []struct {
+		what    string
+		peer    string
+		headers map[string]string
+		client  string
+		https   bool
+		chain   string
+	}{
+		{"no headers", "10.0.0.1:1000", nil, "10.0.0.1:1000", false, "10.0.0.1:1000"},
+		{"untrusted peer", "198.51.100.1:1000", map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			"198.51.100.1:1000", false, "198.51.100.1:1000"},
+		{"x-forwarded-for", "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "203.0.113.9", "X-Forwarded-Proto": "https"},
+			"203.0.113.9", true, "203.0.113.9,10.0.0.1:1000"},
+		{"spoofed x-forwarded-for", "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.9, 10.0.0.2"},
+			"203.0.113.9", false, "1.2.3.4,203.0.113.9,10.0.0.2,10.0.0.1:1000"},
+		{"single trusted address", "192.0.2.1:1000", map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			"203.0.113.9", false, "203.0.113.9,192.0.2.1:1000"},
+		{"next to a trusted address", "192.0.2.2:1000", map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			"192.0.2.2:1000", false, "192.0.2.2:1000"},
+		{"all hops trusted", "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			"10.0.0.3", false, "10.0.0.3,10.0.0.2,10.0.0.1:1000"},
+		{"forwarded", "10.0.0.1:1000", map[string]string{"Forwarded": `for=203.0.113.9;proto=https, for=10.0.0.2;proto=http`},
+			"203.0.113.9", true, "203.0.113.9,10.0.0.2,10.0.0.1:1000"},
+		{"forwarded ipv6 with port", "[2001:db8::1]:1000", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711", for="[2001:db8::2]"`},
+			"2001:db8:cafe::17", false, "[2001:db8:cafe::17]:4711,[2001:db8::2],[2001:db8::1]:1000"},
+		{"forwarded quoted comma", "10.0.0.1:1000", map[string]string{"Forwarded": `for=203.0.113.9;by="a,b"`},
+			"203.0.113.9", false, "203.0.113.9,10.0.0.1:1000"},
+		{"forwarded preferred", "10.0.0.1:1000", map[string]string{"Forwarded": "for=203.0.113.9", "X-Forwarded-For": "198.51.100.7"},
+			"203.0.113.9", false, "203.0.113.9,10.0.0.1:1000"},
+		{"x-real-ip", "10.0.0.1:1000", map[string]string{"X-Real-Ip": "203.0.113.9"},
+			"203.0.113.9", false, "203.0.113.9,10.0.0.1:1000"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		client, https, chain := a.clientAddress(r)
+		test.Is(t, client, c.client, c.what+" client")
+		test.Is(t, https, c.https, c.what+" https")
+		test.Is(t, strings.Join(chain, ","), c.chain, c.what+" chain")
+	}
+}
+
+func TestClientAddressForwardedHeaders(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"trusted_proxies": "10.0.0.0/8", "forwarded_headers": "x-real-ip"}})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.Header.Set("X-Real-Ip", "203.0.113.9")
+	client, _, _ := a.clientAddress(r)
+	test.Is(t, client, "203.0.113.9", "only the configured headers")
+
+	r.Header.Del("X-Real-Ip")
+	client, _, _ = a.clientAddress(r)
+	test.Is(t, client, "10.0.0.1:1000", "other headers ignored")
+}
+
+func TestClientAddressUseXFHeaders(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"use_xf_headers": "true"}})
+	a.HandleFunc("/whoami", func(g *Req) error {
+		return g.SendText([]byte(g.RealRemoteIP + " " + strings.Join(g.ProxyChain, ",")))
+	})
+	r := httptest.NewRequest("GET", "/whoami", nil)
+	r.RemoteAddr = "198.51.100.1:1000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.9")
+	w := doRequestFrom(a, r)
+	test.Is(t, w.Code, http.StatusOK, "status")
+	test.Is(t, w.Body.String(), "203.0.113.9 1.2.3.4,203.0.113.9,198.51.100.1:1000", "last entry believed from anyone")
+}
@@ -0,0 +1,193 @@
+package gop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAProxy PROXY protocol (v1 and v2) on a listener, for when we're behind a TCP load
+// balancer. Connections from proxy_protocol_trusted_cidrs must start with a PROXY header,
+// and the client address from it becomes the connection's RemoteAddr - and so
+// Req.RealRemoteIP. Connections from elsewhere are taken as they are. With no trusted
+// CIDRs nobody is trusted: anyone could claim any address. We wrap the raw listener, so
+// it's still handed over on graceful restart.
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyProtoListener struct {
+	net.Listener
+	app     *App
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func (a *App) proxyProtoListener(l net.Listener) net.Listener {
+	trusted := make([]*net.IPNet, 0)
+	cidrs, _ := a.Cfg.GetList("gop", "proxy_protocol_trusted_cidrs", nil)
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			a.Errorf("Bad proxy_protocol_trusted_cidrs entry [%s]: %s", cidr, err.Error())
+			continue
+		}
+		trusted = append(trusted, ipNet)
+	}
+	if len(trusted) == 0 {
+		a.Critical("PROXY protocol enabled on %s but no proxy_protocol_trusted_cidrs - ignoring PROXY headers from everyone", l.Addr())
+	}
+	timeout, _ := a.Cfg.GetDuration("gop", "proxy_protocol_timeout", 5*time.Second)
+	a.Info("Expecting PROXY protocol headers on %s", l.Addr())
+	return &proxyProtoListener{Listener: l, app: a, trusted: trusted, timeout: timeout}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The header is read on first use, in the connection's own goroutine, so a slow
+	// client can't hold up the accept loop
+	return &proxyProtoConn{Conn: conn, listener: l}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	listener   *proxyProtoListener
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.remoteAddr = c.Conn.RemoteAddr()
+		l := c.listener
+		if !isTrusted(c.remoteAddr.String(), l.trusted) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(l.timeout))
+		addr, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			l.app.Stats.Inc("proxy_protocol.errors", 1)
+			l.app.Errorf("Bad PROXY protocol header from %s: %s", c.remoteAddr, err.Error())
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// The client address from the header. nil for a health check (v1 UNKNOWN, v2 LOCAL) -
+// the connection's own address stands.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	start, err := r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) != "PROXY " {
+		return nil, fmt.Errorf("no PROXY header")
+	}
+	return readProxyV1(r)
+}
+
+// e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, 108)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad v1 source address %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0xf
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	if command == 0 {
+		// LOCAL
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("unknown v2 command %d", command)
+	}
+	switch family >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Unix or unspecified - no usable address
+	return nil, nil
+}
@@ -0,0 +1,103 @@
+package gop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// Send header then a request, and return the status and the client address the app saw
+func sendWithProxyHeader(t *testing.T, addr string, header []byte) (int, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(header)
+	conn.Write([]byte("GET /ip HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err.Error()
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func proxyProtoApp(t *testing.T, trustedCIDRs string) string {
+	cfg := ConfigMap{"gop": {"proxy_protocol": "true"}}
+	if trustedCIDRs != "" {
+		cfg["gop"]["proxy_protocol_trusted_cidrs"] = trustedCIDRs
+	}
+	a := newTestApp(t, cfg)
+	a.HandleFunc("/ip", func(g *Req) error {
+		return g.SendText([]byte(stripPort(g.RealRemoteIP)))
+	})
+	return serveTestApp(t, a)
+}
+
+func proxyV2Header(command byte, src net.IP, srcPort uint16) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, 0x11, 0, 12)
+	header = append(header, src.To4()...)
+	header = append(header, 10, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, srcPort)
+	return binary.BigEndian.AppendUint16(header, 443)
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	addr := proxyProtoApp(t, "127.0.0.0/8")
+
+	code, ip := sendWithProxyHeader(t, addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	test.Is(t, code, 200, "v1 header accepted")
+	test.Is(t, ip, "192.0.2.1", "v1 client address")
+
+	_, ip = sendWithProxyHeader(t, addr, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"))
+	test.Is(t, ip, "2001:db8::1", "v1 IPv6 client address")
+
+	_, ip = sendWithProxyHeader(t, addr, proxyV2Header(1, net.ParseIP("203.0.113.7"), 4444))
+	test.Is(t, ip, "203.0.113.7", "v2 client address")
+
+	_, ip = sendWithProxyHeader(t, addr, []byte("PROXY UNKNOWN\r\n"))
+	test.Is(t, ip, "127.0.0.1", "v1 UNKNOWN keeps the connection's address")
+
+	_, ip = sendWithProxyHeader(t, addr, proxyV2Header(0, net.ParseIP("203.0.113.7"), 4444))
+	test.Is(t, ip, "127.0.0.1", "v2 LOCAL keeps the connection's address")
+
+	code, _ = sendWithProxyHeader(t, addr, nil)
+	test.Is(t, code, 0, "trusted peer without a header is dropped")
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	for _, cidrs := range []string{"10.0.0.0/8", ""} {
+		addr := proxyProtoApp(t, cidrs)
+		code, ip := sendWithProxyHeader(t, addr, nil)
+		test.Is(t, code, 200, "untrusted peer served without a header ["+cidrs+"]")
+		test.Is(t, ip, "127.0.0.1", "untrusted peer's own address ["+cidrs+"]")
+
+		code, _ = sendWithProxyHeader(t, addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		test.Is(t, code, http.StatusBadRequest, "header from untrusted peer not believed ["+cidrs+"]")
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 not-an-ip 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n",
+		"PROXY " + string(bytes.Repeat([]byte("x"), 200)) + "\r\n",
+		string(proxyV2Signature) + "\x31\x11\x00\x0c",
+	} {
+		_, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(header))))
+		test.OK(t, err != nil, fmt.Sprintf("bad header refused: %.20q", header))
+	}
+}
@@ -0,0 +1,180 @@
+package gop
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket rate limiting, configured in the [ratelimit] section. Options can be set for
+// a single route as "<route>.<option>", in which case that route gets its own buckets;
+// otherwise all routes share the app-wide buckets. Config is read per request, so changes
+// made via /gop/config take effect immediately.
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	app       *App
+	buckets   map[string]*tokenBucket
+	keyFunc   func(g *Req) string
+	lastSweep time.Time
+}
+
+type rateLimitConfig struct {
+	scope string
+	rate  float64 // tokens per second
+	burst float64
+	key   string
+}
+
+func (a *App) initRateLimit() {
+	a.rateLimiter = &rateLimiter{
+		app:       a,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Set the function used to get the rate limit key for requests when the [ratelimit]
+// key is "custom". Call before Run().
+func (a *App) SetRateLimitKeyFunc(f func(g *Req) string) {
+	a.rateLimiter.keyFunc = f
+}
+
+// The address without any port. Handles IPv6 ([::1]:80) as well as IPv4.
+func stripPort(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port
+		return strings.Trim(addr, "[]")
+	}
+	return host
+}
+
+func (rl *rateLimiter) config(routeName string) rateLimitConfig {
+	cfg := &rl.app.Cfg
+	_, routeRate := cfg.Get("ratelimit", routeName+".rate", "")
+	_, routeBurst := cfg.Get("ratelimit", routeName+".burst", "")
+	_, routeKey := cfg.Get("ratelimit", routeName+".key", "")
+	prefix := ""
+	rlCfg := rateLimitConfig{scope: "*"}
+	if routeRate || routeBurst || routeKey {
+		prefix = routeName + "."
+		rlCfg.scope = routeName
+	}
+	get := func(option, defaultValue string) string {
+		v, _ := cfg.Get("ratelimit", option, defaultValue)
+		v, _ = cfg.Get("ratelimit", prefix+option, v)
+		return v
+	}
+	getFloat := func(option string) float64 {
+		v := rl.app.configFloat("ratelimit", option, 0)
+		return rl.app.configFloat("ratelimit", prefix+option, v)
+	}
+	rate := getFloat("rate")
+	burst := getFloat("burst")
+	if burst < 1 {
+		burst = math.Max(1, rate)
+	}
+	rlCfg.rate = rate
+	rlCfg.burst = burst
+	rlCfg.key = get("key", "ip")
+	return rlCfg
+}
+
+// Who the request counts against. "" means don't limit it.
+func (rl *rateLimiter) requestKey(g *Req, key string) string {
+	switch {
+	case key == "ip":
+		return stripPort(g.RealRemoteIP)
+	case strings.HasPrefix(key, "header:"):
+		return g.R.Header.Get(strings.TrimPrefix(key, "header:"))
+	case key == "custom":
+		if rl.keyFunc == nil {
+			g.Error("Rate limit key is 'custom' but no key func set - not limiting")
+			return ""
+		}
+		return rl.keyFunc(g)
+	}
+	g.Errorf("Unknown rate limit key [%s] - not limiting", key)
+	return ""
+}
+
+// Take a token for the request. Sets the RateLimit-* headers, and returns a 429 HTTPError
+// if the client is over its limit.
+func (rl *rateLimiter) check(g *Req) error {
+	rlCfg := rl.config(g.routeName)
+	if rlCfg.rate <= 0 {
+		return nil
+	}
+	key := rl.requestKey(g, rlCfg.key)
+	if key == "" {
+		return nil
+	}
+
+	allowed, remaining := rl.take(rlCfg, key, time.Now())
+
+	// Secs until there's a token, and until the bucket is full
+	untilToken := math.Ceil(math.Max(0, 1-remaining) / rlCfg.rate)
+	untilFull := math.Ceil((rlCfg.burst - remaining) / rlCfg.rate)
+	h := g.W.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(int(rlCfg.burst)))
+	h.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(untilFull)))
+
+	if allowed {
+		return nil
+	}
+	g.app.Stats.Inc("ratelimit.rejected", 1)
+	g.Stats.Inc("ratelimit.rejected", 1)
+	g.Debug("Rate limited [%s] on %s", key, rlCfg.scope)
+	return HTTPError{
+		Code:      http.StatusTooManyRequests,
+		Body:      "Rate limit exceeded",
+		ErrorCode: "rate_limited",
+	}.WithHeader("Retry-After", strconv.Itoa(int(untilToken)))
+}
+
+// Take a token from the key's bucket, if it has one. Returns the tokens left.
+func (rl *rateLimiter) take(rlCfg rateLimitConfig, key string, now time.Time) (bool, float64) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.sweep(now)
+	bucketKey := rlCfg.scope + "|" + key
+	b, ok := rl.buckets[bucketKey]
+	if !ok {
+		b = &tokenBucket{tokens: rlCfg.burst, updated: now}
+		rl.buckets[bucketKey] = b
+	}
+	b.tokens = math.Min(rlCfg.burst, b.tokens+now.Sub(b.updated).Seconds()*rlCfg.rate)
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return allowed, b.tokens
+}
+
+// Drop buckets which have been idle long enough to be full again - they are the same
+// as a new bucket. Must hold the lock.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for k, b := range rl.buckets {
+		scope := k[:strings.IndexByte(k, '|')]
+		rlCfg := rl.config(scope)
+		if rlCfg.rate <= 0 || b.tokens+now.Sub(b.updated).Seconds()*rlCfg.rate >= rlCfg.burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
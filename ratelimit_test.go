@@ -0,0 +1,73 @@
+package gop
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestRateLimitPerIP(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"ratelimit": {"rate": "1", "burst": "2"}})
+	a.HandleFunc("/x", func(g *Req) error { return nil })
+	codes := make([]int, 0)
+	var last *http.Response
+	for i := 0; i < 3; i++ {
+		w := doRequest(a, "GET", "/x", nil, nil)
+		codes = append(codes, w.Code)
+		last = w.Result()
+	}
+	test.Is(t, codes, []int{200, 200, 429}, "burst allowed, then limited")
+	test.Is(t, last.Header.Get("RateLimit-Limit"), "2", "limit header")
+	test.Is(t, last.Header.Get("RateLimit-Remaining"), "0", "remaining header")
+	test.Is(t, last.Header.Get("Retry-After"), "1", "retry after a token's time")
+
+	r, _ := http.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "192.0.2.9:1234"
+	w := doRequestFrom(a, r)
+	test.Is(t, w.Code, 200, "another client has its own bucket")
+}
+
+func TestRateLimitPerRouteKey(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"ratelimit": {"api.rate": "1", "api.burst": "1", "api.key": "header:X-Api-Key"}})
+	a.HandleFunc("/api", func(g *Req) error { return nil }).Name("api")
+	a.HandleFunc("/other", func(g *Req) error { return nil }).Name("other")
+
+	key := map[string]string{"X-Api-Key": "k1"}
+	test.Is(t, doRequest(a, "GET", "/api", nil, key).Code, 200, "first request with key")
+	test.Is(t, doRequest(a, "GET", "/api", nil, key).Code, 429, "second request with key limited")
+	test.Is(t, doRequest(a, "GET", "/api", nil, map[string]string{"X-Api-Key": "k2"}).Code, 200, "other key not limited")
+	test.Is(t, doRequest(a, "GET", "/api", nil, nil).Code, 200, "requests without the key not limited")
+	test.Is(t, doRequest(a, "GET", "/other", nil, nil).Code, 200, "other routes not limited")
+}
+
+func TestRateLimitBadConfig(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"ratelimit": {"rate": "1", "burst": "5"}})
+	a.HandleFunc("/a", func(g *Req) error { return nil }).Name("a")
+	a.HandleFunc("/b", func(g *Req) error { return nil }).Name("b")
+	test.Is(t, doRequest(a, "GET", "/a", nil, nil).Code, 200, "route a limited but allowed")
+
+	// As from a /gop/config PUT
+	waitRetired(a)
+	a.Cfg.TransientOverride("ratelimit", "a.rate", "lots")
+	a.Cfg.TransientOverride("ratelimit", "b.burst", "many")
+	test.Is(t, doRequest(a, "GET", "/a", nil, nil).Code, 200, "bad route rate falls back to the app-wide one")
+
+	// Make the next request sweep the buckets, which reads route a's config
+	a.rateLimiter.Lock()
+	a.rateLimiter.lastSweep = time.Now().Add(-time.Hour)
+	a.rateLimiter.Unlock()
+	done := make(chan int, 1)
+	go func() { done <- doRequest(a, "GET", "/b", nil, nil).Code }()
+	select {
+	case code := <-done:
+		test.Is(t, code, 200, "bad burst doesn't stop requests")
+	case <-time.After(2 * time.Second):
+		t.Fatal("request hung after a bad config value")
+	}
+	for i := 0; i < 4; i++ {
+		doRequest(a, "GET", "/b", nil, nil)
+	}
+	test.Is(t, doRequest(a, "GET", "/b", nil, nil).Code, 429, "bad route burst falls back to the app-wide one")
+}
@@ -0,0 +1,139 @@
+package gop
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/cocoonlife/timber"
+)
+
+// Request ids are random, so unique across processes and graceful restarts. If
+// trust_request_id_header is set, an id passed in by the caller (e.g. a proxy) is used instead.
+
+const maxRequestIDLen = 128
+
+func newRequestID() string {
+	var b [16]byte
+	randomBytes(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Only take ids which are safe to put in logs and headers as-is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		ok := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == ':'
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *App) requestIDHeader() string {
+	header, _ := a.Cfg.Get("gop", "request_id_header", "X-Request-Id")
+	return header
+}
+
+func (a *App) requestIDFor(r *http.Request) string {
+	trustInbound := a.configBool("gop", "trust_request_id_header", false)
+	if trustInbound {
+		id := r.Header.Get(a.requestIDHeader())
+		if validRequestID(id) {
+			return id
+		}
+	}
+	return newRequestID()
+}
+
+// The id of this request, as sent in the response header and logged. Pass it on
+// (in the request_id_header) to outbound calls to tie their logs to this request.
+func (g *Req) RequestID() string {
+	return g.requestID
+}
+
+// The Req logging methods shadow those of the app Logger, to tag every line with the request id
+
+func (g *Req) withRequestID(arg0 interface{}) interface{} {
+	s, ok := arg0.(string)
+	if !ok {
+		return arg0
+	}
+	return "[" + g.requestID + "] " + s
+}
+
+// The app's request logger, which reports the right caller for %S, unless the app
+// has replaced the Logger
+func (g *Req) log() Logger {
+	if g.app != nil && g.app.reqLogger != nil && g.Logger == Logger(timber.Global) {
+		return g.app.reqLogger
+	}
+	return g.Logger
+}
+
+func (g *Req) Finest(arg0 interface{}, args ...interface{}) {
+	g.log().Finest(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Fine(arg0 interface{}, args ...interface{}) {
+	g.log().Fine(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Debug(arg0 interface{}, args ...interface{}) {
+	g.log().Debug(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Trace(arg0 interface{}, args ...interface{}) {
+	g.log().Trace(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Info(arg0 interface{}, args ...interface{}) {
+	g.log().Info(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Warn(arg0 interface{}, args ...interface{}) error {
+	return g.log().Warn(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Error(arg0 interface{}, args ...interface{}) error {
+	return g.log().Error(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Critical(arg0 interface{}, args ...interface{}) error {
+	return g.log().Critical(g.withRequestID(arg0), args...)
+}
+
+func (g *Req) Finestf(format string, args ...interface{}) {
+	g.log().Finestf("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Finef(format string, args ...interface{}) {
+	g.log().Finef("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Debugf(format string, args ...interface{}) {
+	g.log().Debugf("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Tracef(format string, args ...interface{}) {
+	g.log().Tracef("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Infof(format string, args ...interface{}) {
+	g.log().Infof("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Warnf(format string, args ...interface{}) error {
+	return g.log().Warnf("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Errorf(format string, args ...interface{}) error {
+	return g.log().Errorf("["+g.requestID+"] "+format, args...)
+}
+
+func (g *Req) Criticalf(format string, args ...interface{}) error {
+	return g.log().Criticalf("["+g.requestID+"] "+format, args...)
+}
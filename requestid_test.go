@@ -0,0 +1,161 @@
+package gop
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// Req has to stay usable wherever a Logger is wanted
+var _ Logger = (*Req)(nil)
+
+// Records the levelled logging; anything else would panic on the nil Logger
+type recordingLogger struct {
+	Logger
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) add(level string, arg0 interface{}, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(fmt.Sprint(arg0), args...))
+}
+
+func (l *recordingLogger) Finest(arg0 interface{}, args ...interface{}) {
+	l.add("FINEST", arg0, args...)
+}
+func (l *recordingLogger) Fine(arg0 interface{}, args ...interface{})  { l.add("FINE", arg0, args...) }
+func (l *recordingLogger) Debug(arg0 interface{}, args ...interface{}) { l.add("DEBUG", arg0, args...) }
+func (l *recordingLogger) Trace(arg0 interface{}, args ...interface{}) { l.add("TRACE", arg0, args...) }
+func (l *recordingLogger) Info(arg0 interface{}, args ...interface{})  { l.add("INFO", arg0, args...) }
+func (l *recordingLogger) Warn(arg0 interface{}, args ...interface{}) error {
+	l.add("WARN", arg0, args...)
+	return nil
+}
+func (l *recordingLogger) Error(arg0 interface{}, args ...interface{}) error {
+	l.add("ERROR", arg0, args...)
+	return nil
+}
+func (l *recordingLogger) Critical(arg0 interface{}, args ...interface{}) error {
+	l.add("CRITICAL", arg0, args...)
+	return nil
+}
+func (l *recordingLogger) Finestf(format string, args ...interface{}) {
+	l.add("FINEST", format, args...)
+}
+func (l *recordingLogger) Finef(format string, args ...interface{})  { l.add("FINE", format, args...) }
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.add("DEBUG", format, args...) }
+func (l *recordingLogger) Tracef(format string, args ...interface{}) { l.add("TRACE", format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.add("INFO", format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{}) error {
+	l.add("WARN", format, args...)
+	return nil
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) error {
+	l.add("ERROR", format, args...)
+	return nil
+}
+func (l *recordingLogger) Criticalf(format string, args ...interface{}) error {
+	l.add("CRITICAL", format, args...)
+	return nil
+}
+
+func (l *recordingLogger) logged() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	a := newTestApp(t, nil)
+	var seen string
+	a.HandleFunc("/id", func(g *Req) error {
+		seen = g.RequestID()
+		return g.SendText([]byte("ok"))
+	})
+
+	w := doRequest(a, "GET", "/id", nil, map[string]string{"X-Request-Id": "from-the-client"})
+	test.OK(t, regexp.MustCompile("^[0-9a-f]{32}$").MatchString(seen), "random id "+seen)
+	test.Is(t, w.Header().Get("X-Request-Id"), seen, "id sent back")
+	first := seen
+	doRequest(a, "GET", "/id", nil, nil)
+	test.OK(t, seen != first, "ids differ")
+}
+
+func TestRequestIDTrusted(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {
+		"trust_request_id_header": "true",
+		"request_id_header":       "X-Correlation-Id",
+	}})
+	var seen string
+	a.HandleFunc("/id", func(g *Req) error {
+		seen = g.RequestID()
+		return g.SendText([]byte("ok"))
+	})
+
+	w := doRequest(a, "GET", "/id", nil, map[string]string{"X-Correlation-Id": "abc-123:4.5_6"})
+	test.Is(t, seen, "abc-123:4.5_6", "inbound id used")
+	test.Is(t, w.Header().Get("X-Correlation-Id"), "abc-123:4.5_6", "inbound id sent back")
+	test.Is(t, w.Header().Get("X-Request-Id"), "", "default header not sent")
+
+	for _, bad := range []string{"has space", "new\nline", "<script>", string(make([]byte, maxRequestIDLen+1))} {
+		doRequest(a, "GET", "/id", nil, map[string]string{"X-Correlation-Id": bad})
+		test.OK(t, seen != bad && validRequestID(seen), fmt.Sprintf("%.20q replaced", bad))
+	}
+
+	// As from a /gop/config PUT
+	waitRetired(a)
+	a.Cfg.TransientOverride("gop", "trust_request_id_header", "yes please")
+	w = doRequest(a, "GET", "/id", nil, map[string]string{"X-Correlation-Id": "abc-123"})
+	test.Is(t, w.Code, 200, "bad trust_request_id_header doesn't stop requests")
+	test.OK(t, seen != "abc-123" && validRequestID(seen), "bad value means the default of not trusting")
+}
+
+func TestRequestLogging(t *testing.T) {
+	a := newTestApp(t, nil)
+	logger := &recordingLogger{}
+	a.Logger = logger
+	var id string
+	a.HandleFunc("/logs", func(g *Req) error {
+		id = g.RequestID()
+		g.Finest("finest %d", 1)
+		g.Fine("fine %d", 2)
+		g.Debug("debug %d", 3)
+		g.Trace("trace %d", 4)
+		g.Info("info %d", 5)
+		g.Warn("warn %d", 6)
+		g.Error("error %d", 7)
+		g.Critical("critical %d", 8)
+		g.Finestf("finestf %d", 9)
+		g.Finef("finef %d", 10)
+		g.Debugf("debugf %d", 11)
+		g.Tracef("tracef %d", 12)
+		g.Infof("infof %d", 13)
+		g.Warnf("warnf %d", 14)
+		g.Errorf("errorf %d", 15)
+		g.Criticalf("criticalf %d", 16)
+		return g.SendText([]byte("ok"))
+	})
+
+	w := doRequest(a, "GET", "/logs", nil, nil)
+	test.Is(t, w.Code, http.StatusOK, "status")
+	want := []string{
+		"FINEST [%s] finest 1", "FINE [%s] fine 2", "DEBUG [%s] debug 3", "TRACE [%s] trace 4",
+		"INFO [%s] info 5", "WARN [%s] warn 6", "ERROR [%s] error 7", "CRITICAL [%s] critical 8",
+		"FINEST [%s] finestf 9", "FINE [%s] finef 10", "DEBUG [%s] debugf 11", "TRACE [%s] tracef 12",
+		"INFO [%s] infof 13", "WARN [%s] warnf 14", "ERROR [%s] errorf 15", "CRITICAL [%s] criticalf 16",
+	}
+	got := make(map[string]bool)
+	for _, line := range logger.logged() {
+		got[line] = true
+	}
+	for _, line := range want {
+		line = fmt.Sprintf(line, id)
+		test.OK(t, got[line], "logged "+line)
+	}
+}
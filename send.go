@@ -0,0 +1,378 @@
+package gop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encodes v for Req.Send. Register with App.RegisterEncoder.
+type Encoder func(w io.Writer, v interface{}) error
+
+type registeredEncoder struct {
+	mimetype string
+	encode   Encoder
+	handles  func(v interface{}) bool // nil for anything
+}
+
+// The built-in encoders, in order of preference when the client doesn't mind
+func defaultEncoders() []registeredEncoder {
+	return []registeredEncoder{
+		{"application/json", encodeJSON, nil},
+		{"application/xml", encodeXML, nil},
+		{"application/msgpack", encodeMsgpack, nil},
+		{"text/csv", encodeCSV, csvEncodable},
+		{"text/plain", encodeText, nil},
+	}
+}
+
+// Add (or replace) the encoder used by Req.Send for a mime type. New mime types
+// are least preferred when the Accept header doesn't pick one out. Call before Run().
+func (a *App) RegisterEncoder(mimetype string, enc Encoder) {
+	for i := range a.encoders {
+		if a.encoders[i].mimetype == mimetype {
+			a.encoders[i].encode = enc
+			a.encoders[i].handles = nil
+			return
+		}
+	}
+	a.encoders = append(a.encoders, registeredEncoder{mimetype, enc, nil})
+}
+
+type acceptRange struct {
+	mimetype string
+	q        float64
+}
+
+// Parse an Accept header into ranges, in the order given
+func parseAccept(accept string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mimetype := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mimetype == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		ranges = append(ranges, acceptRange{mimetype, q})
+	}
+	return ranges
+}
+
+// How specifically the range matches mimetype: 0 for not at all, 1 for */*, 2 for
+// type/*, 3 for the type itself
+func (r acceptRange) specificity(mimetype string) int {
+	switch {
+	case r.mimetype == mimetype:
+		return 3
+	// Common aliases
+	case r.mimetype == "application/x-msgpack" && mimetype == "application/msgpack",
+		r.mimetype == "text/xml" && mimetype == "application/xml":
+		return 3
+	case strings.HasSuffix(r.mimetype, "/*") && r.mimetype != "*/*":
+		if strings.HasPrefix(mimetype, r.mimetype[:len(r.mimetype)-1]) {
+			return 2
+		}
+	case r.mimetype == "*/*":
+		return 1
+	}
+	return 0
+}
+
+// The q the ranges give mimetype, from the most specific range that matches it (the
+// first, if several are as specific), and that range's place in the header. -1 if
+// none match.
+func acceptQuality(ranges []acceptRange, mimetype string) (q float64, index int) {
+	best := 0
+	index = -1
+	for i, r := range ranges {
+		if s := r.specificity(mimetype); s > best {
+			best, q, index = s, r.q, i
+		}
+	}
+	return q, index
+}
+
+// Pick the encoder for v and the Accept header: the one with the highest q, then the
+// one whose range the client listed first, then ours in order of preference. Encoders
+// which can't do v (e.g. CSV for a map) are passed over. nil if the client won't accept
+// anything we have - a q of 0 means "not this".
+func (g *Req) negotiateEncoder(v interface{}) *registeredEncoder {
+	encoders := g.app.encoders
+	accept := g.R.Header.Get("Accept")
+	ranges := parseAccept(accept)
+	if accept == "" {
+		ranges = []acceptRange{{"*/*", 1}}
+	}
+	var best *registeredEncoder
+	bestQ, bestIndex := 0.0, 0
+	for i := range encoders {
+		if encoders[i].handles != nil && !encoders[i].handles(v) {
+			continue
+		}
+		q, index := acceptQuality(ranges, encoders[i].mimetype)
+		if index < 0 || q <= 0 {
+			continue
+		}
+		if best == nil || q > bestQ || (q == bestQ && index < bestIndex) {
+			best, bestQ, bestIndex = &encoders[i], q, index
+		}
+	}
+	return best
+}
+
+// Send v with the given status code, encoded according to the request's Accept header
+// (JSON by default). Built-in encodings are JSON, XML (slices wrapped in <items>),
+// MessagePack, CSV (only for [][]string or a slice of structs) and text; add more with
+// App.RegisterEncoder.
+// Returns a 406 HTTPError if we have no acceptable encoding.
+func (g *Req) Send(code int, v interface{}) error {
+	enc := g.negotiateEncoder(v)
+	if enc == nil {
+		return HTTPError{Code: http.StatusNotAcceptable, Body: "No acceptable content type"}
+	}
+	var buf bytes.Buffer
+	err := enc.encode(&buf, v)
+	if err != nil {
+		g.Errorf("Failed to encode response as %s: %s", enc.mimetype, err.Error())
+		return ServerError("Failed to encode " + enc.mimetype + ": " + err.Error())
+	}
+	g.W.Header().Add("Vary", "Accept")
+	g.W.Header().Set("Content-Type", mimetypeWithCharset(enc.mimetype))
+	g.W.WriteHeader(code)
+	g.W.Write(buf.Bytes())
+	return nil
+}
+
+func mimetypeWithCharset(mimetype string) string {
+	if strings.HasPrefix(mimetype, "text/") {
+		return mimetype + "; charset=utf-8"
+	}
+	return mimetype
+}
+
+func encodeJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// A slice would otherwise be a series of root elements, which isn't a document
+func encodeXML(w io.Writer, v interface{}) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	rv := reflect.ValueOf(v)
+	isList := rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array
+	if !isList || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return enc.Encode(v)
+	}
+	root := xml.StartElement{Name: xml.Name{Local: "items"}}
+	err = enc.EncodeToken(root)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(v)
+	if err != nil {
+		return err
+	}
+	err = enc.EncodeToken(root.End())
+	if err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func encodeText(w io.Writer, v interface{}) error {
+	var err error
+	switch v := v.(type) {
+	case string:
+		_, err = io.WriteString(w, v)
+	case []byte:
+		_, err = w.Write(v)
+	default:
+		_, err = fmt.Fprintf(w, "%v\n", v)
+	}
+	return err
+}
+
+// [][]string, or a slice of structs
+func csvEncodable(v interface{}) bool {
+	if _, ok := v.([][]string); ok {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return false
+	}
+	elemType := rv.Type().Elem()
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	return elemType.Kind() == reflect.Struct
+}
+
+// CSV from [][]string, or from a slice of structs with a header row of field names
+func encodeCSV(w io.Writer, v interface{}) error {
+	cw := csv.NewWriter(w)
+	if rows, ok := v.([][]string); ok {
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+	if !csvEncodable(v) {
+		return fmt.Errorf("can't encode %T as csv", v)
+	}
+	rv := reflect.ValueOf(v)
+	elemType := rv.Type().Elem()
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	fields := make([]int, 0)
+	header := make([]string, 0)
+	for i := 0; i < elemType.NumField(); i++ {
+		f := elemType.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fields = append(fields, i)
+		header = append(header, fieldName(f))
+	}
+	cw.Write(header)
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i)
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		row := make([]string, len(fields))
+		for j, f := range fields {
+			row[j] = fmt.Sprint(elem.Field(f).Interface())
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// MessagePack. We go via JSON so json struct tags (and Marshalers) are honoured.
+func encodeMsgpack(w io.Writer, v interface{}) error {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	dec.UseNumber()
+	err = dec.Decode(&generic)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeMsgpack(&buf, generic)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func writeMsgpackLen(buf *bytes.Buffer, n int, fixLimit int, fix, b16, b32 byte) {
+	switch {
+	case n <= fixLimit:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+		} else {
+			f, _ := v.Float64()
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, f)
+		}
+	case string:
+		writeMsgpackLen(buf, len(v), 31, 0xa0, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLen(buf, len(v), 15, 0x90, 0xdc, 0xdd)
+		for _, elem := range v {
+			writeMsgpack(buf, elem)
+		}
+	case map[string]interface{}:
+		writeMsgpackLen(buf, len(v), 15, 0x80, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeMsgpack(buf, k)
+			writeMsgpack(buf, v[k])
+		}
+	}
+}
+
+// A chunked response, flushed to the client on every write
+type Stream struct {
+	g *Req
+}
+
+// Start a streaming (chunked) response with the given status and content type.
+// For newline delimited JSON use "application/x-ndjson" and Stream.Send.
+func (g *Req) SendStream(code int, mimetype string) *Stream {
+	g.W.Header().Set("Content-Type", mimetype)
+	g.W.Header().Set("X-Content-Type-Options", "nosniff")
+	g.W.WriteHeader(code)
+	g.W.Flush()
+	return &Stream{g: g}
+}
+
+// Write raw bytes to the stream and flush them
+func (s *Stream) Write(buf []byte) (int, error) {
+	n, err := s.g.W.Write(buf)
+	s.g.W.Flush()
+	return n, err
+}
+
+// Write v as a single line of JSON and flush it
+func (s *Stream) Send(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(append(line, '\n'))
+	return err
+}
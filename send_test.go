@@ -0,0 +1,331 @@
+package gop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/trendmicro/gop/test"
+)
+
+type sendItem struct {
+	Name  string `json:"name" xml:"name"`
+	Count int    `json:"count" xml:"count"`
+}
+
+func newSendApp(t *testing.T) *App {
+	a := newTestApp(t, nil)
+	a.HandleFunc("/items", func(g *Req) error {
+		return g.Send(http.StatusOK, []sendItem{{"a", 1}, {"b", 2}})
+	})
+	a.HandleFunc("/item", func(g *Req) error {
+		return g.Send(http.StatusOK, sendItem{"a", 1})
+	})
+	return a
+}
+
+func TestSendNegotiation(t *testing.T) {
+	a := newSendApp(t)
+	cases := []struct {
+		accept string
+		want   string // the content type, or "" for a 406
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/xml", "application/xml"},
+		{"application/x-msgpack", "application/msgpack"},
+		{"text/*", "text/csv; charset=utf-8"},
+		{"text/plain, text/csv", "text/plain; charset=utf-8"},
+		{"application/xml, application/json", "application/xml"},
+		{"application/json;q=0.5, application/xml;q=0.9", "application/xml"},
+		{"application/json;q=0.5, */*;q=0.1", "application/json"},
+		// The most specific range gives a type its q, wherever it is
+		{"application/json;q=0, */*", "application/xml"},
+		{"*/*, application/json;q=0", "application/xml"},
+		{"text/*;q=0.1, text/plain;q=0.8, */*;q=0.5", "text/plain; charset=utf-8"},
+		{"application/*;q=0.2, application/xml;q=0.1, */*;q=0.05", "application/json"},
+		{"application/*;q=0, text/csv", "text/csv; charset=utf-8"},
+		{"image/png", ""},
+		{"*/*;q=0", ""},
+		{"application/json;q=0", ""},
+	}
+	for _, c := range cases {
+		w := doRequest(a, "GET", "/items", nil, map[string]string{"Accept": c.accept})
+		if c.want == "" {
+			test.Is(t, w.Code, http.StatusNotAcceptable, "Accept: "+c.accept)
+			continue
+		}
+		test.Is(t, w.Code, http.StatusOK, "Accept: "+c.accept+" status")
+		test.Is(t, w.Header().Get("Content-Type"), c.want, "Accept: "+c.accept)
+		test.Is(t, w.Header().Get("Vary"), "Accept", "Vary")
+	}
+
+	// CSV is only for lists
+	cases = []struct {
+		accept string
+		want   string
+	}{
+		{"text/*", "text/plain; charset=utf-8"},
+		{"text/csv, text/plain;q=0.5", "text/plain; charset=utf-8"},
+		{"text/csv", ""},
+	}
+	for _, c := range cases {
+		w := doRequest(a, "GET", "/item", nil, map[string]string{"Accept": c.accept})
+		if c.want == "" {
+			test.Is(t, w.Code, http.StatusNotAcceptable, "single item, Accept: "+c.accept)
+			continue
+		}
+		test.Is(t, w.Code, http.StatusOK, "single item, Accept: "+c.accept+" status")
+		test.Is(t, w.Header().Get("Content-Type"), c.want, "single item, Accept: "+c.accept)
+	}
+}
+
+func TestSendEncodings(t *testing.T) {
+	a := newSendApp(t)
+	body := func(accept string) string {
+		w := doRequest(a, "GET", "/items", nil, map[string]string{"Accept": accept})
+		return w.Body.String()
+	}
+	test.Is(t, body("application/json"), `[{"name":"a","count":1},{"name":"b","count":2}]`+"\n", "JSON")
+	test.OK(t, strings.Contains(body("application/xml"), "<items><sendItem><name>a</name><count>1</count></sendItem>"), "XML")
+	var doc struct {
+		XMLName xml.Name   `xml:"items"`
+		Items   []sendItem `xml:"sendItem"`
+	}
+	test.ErrIs(t, xml.Unmarshal([]byte(body("application/xml")), &doc), nil, "XML list is one document")
+	test.Is(t, doc.Items, []sendItem{{"a", 1}, {"b", 2}}, "XML list items")
+	w := doRequest(a, "GET", "/item", nil, map[string]string{"Accept": "application/xml"})
+	test.OK(t, strings.HasSuffix(w.Body.String(), "?>\n<sendItem><name>a</name><count>1</count></sendItem>"), "XML single item isn't wrapped")
+	test.Is(t, body("text/csv"), "name,count\na,1\nb,2\n", "CSV")
+
+	a.RegisterEncoder("text/x-names", func(w io.Writer, v interface{}) error {
+		for _, item := range v.([]sendItem) {
+			io.WriteString(w, item.Name+"\n")
+		}
+		return nil
+	})
+	test.Is(t, body("text/x-names"), "a\nb\n", "registered encoder")
+	test.OK(t, strings.HasPrefix(body("*/*"), "["), "registered encoder isn't preferred")
+}
+
+func TestSendMsgpackRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 70000)
+	list := make([]interface{}, 20)
+	wide := make(map[string]interface{})
+	for i := range list {
+		list[i] = i * 1000
+		wide[fmt.Sprint("k", i)] = i
+	}
+	v := map[string]interface{}{
+		"nil":      nil,
+		"true":     true,
+		"false":    false,
+		"small":    7,
+		"negative": -300,
+		"big":      int64(math.MaxInt64),
+		"float":    1.5,
+		"empty":    "",
+		"fixstr":   "héllo",
+		"str8":     strings.Repeat("y", 40),
+		"str32":    long,
+		"list":     list,
+		"wide":     wide,
+		"items":    []sendItem{{"a", 1}},
+	}
+	var buf bytes.Buffer
+	test.ErrIs(t, encodeMsgpack(&buf, v), nil, "encode")
+	r := bytes.NewReader(buf.Bytes())
+	decoded, err := decodeMsgpack(r)
+	test.ErrIs(t, err, nil, "decode")
+	test.Is(t, r.Len(), 0, "nothing left over")
+
+	// What we expect: the value as JSON sees it
+	jsonBytes, _ := json.Marshal(v)
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	dec.UseNumber()
+	var want interface{}
+	dec.Decode(&want)
+	test.OK(t, reflect.DeepEqual(decoded, jsonNumbers(want)), "msgpack round trip")
+}
+
+// json.Numbers as the int64 or float64 we'd decode from msgpack
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = jsonNumbers(v[k])
+		}
+	}
+	return v
+}
+
+// A MessagePack decoder written from the spec, for checking ours. Covers every format
+// bar bin and ext, which we never send.
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	readLen := func(size int) (int, error) {
+		buf, err := readN(size)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for _, c := range buf {
+			n = n<<8 | int(c)
+		}
+		return n, nil
+	}
+	readStr := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		buf, err := readN(n)
+		return string(buf), err
+	}
+	readArray := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i], err = decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	readMap := func(n int, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v isn't a string", k)
+			}
+			m[key], err = decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	readInt := func(size int, signed bool) (interface{}, error) {
+		buf, err := readN(size)
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, c := range buf {
+			u = u<<8 | uint64(c)
+		}
+		if signed && size < 8 && buf[0]&0x80 != 0 {
+			u |= math.MaxUint64 << (8 * size)
+		}
+		return int64(u), nil
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return readStr(int(b&0x1f), nil)
+	case b&0xf0 == 0x90:
+		return readArray(int(b&0x0f), nil)
+	case b&0xf0 == 0x80:
+		return readMap(int(b&0x0f), nil)
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		var f float32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(f), err
+	case 0xcb:
+		var f float64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return f, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return readInt(1<<(b-0xcc), false)
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return readInt(1<<(b-0xd0), true)
+	case 0xd9, 0xda, 0xdb:
+		return readStr(readLen(1 << (b - 0xd9)))
+	case 0xdc, 0xdd:
+		return readArray(readLen(2 << (b - 0xdc)))
+	case 0xde, 0xdf:
+		return readMap(readLen(2 << (b - 0xde)))
+	}
+	return nil, fmt.Errorf("unexpected msgpack byte %#x", b)
+}
+
+func TestSendStream(t *testing.T) {
+	a := newTestApp(t, nil)
+	next := make(chan bool)
+	a.HandleFunc("/stream", func(g *Req) error {
+		stream := g.SendStream(http.StatusAccepted, "application/x-ndjson")
+		stream.Send(sendItem{"a", 1})
+		<-next
+		stream.Send(sendItem{"b", 2})
+		return nil
+	}).Streaming()
+	addr := serveTestApp(t, a)
+	resp, err := http.Get("http://" + addr + "/stream")
+	test.ErrIs(t, err, nil, "get")
+	defer resp.Body.Close()
+	test.Is(t, resp.StatusCode, http.StatusAccepted, "status")
+	test.Is(t, resp.Header.Get("Content-Type"), "application/x-ndjson", "content type")
+	test.Is(t, resp.Header.Get("X-Content-Type-Options"), "nosniff", "nosniff")
+	test.Is(t, resp.TransferEncoding, []string{"chunked"}, "chunked")
+
+	// Each line arrives as it's sent
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadString('\n')
+	test.ErrIs(t, err, nil, "first line")
+	test.Is(t, line, `{"name":"a","count":1}`+"\n", "first line arrives before the second is sent")
+	next <- true
+	line, err = lines.ReadString('\n')
+	test.ErrIs(t, err, nil, "second line")
+	test.Is(t, line, `{"name":"b","count":2}`+"\n", "second line")
+	_, err = lines.ReadString('\n')
+	test.ErrIs(t, err, io.EOF, "end of stream")
+}
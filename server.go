@@ -0,0 +1,85 @@
+package gop
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The http.Server for each listener, with its timeouts and limits from config. Changes
+// need a (graceful) restart. HTTP/2 is served over TLS unless http2_enable is off, and
+// in cleartext (h2c, prior knowledge only) if the listener has h2c set.
+func (a *App) httpServer(handler http.Handler, h2c bool) *http.Server {
+	readHeaderTimeout, _ := a.Cfg.GetDuration("gop", "http_read_header_timeout", 10*time.Second)
+	readTimeout, _ := a.Cfg.GetDuration("gop", "http_read_timeout", 0)
+	writeTimeout, _ := a.Cfg.GetDuration("gop", "http_write_timeout", 0)
+	idleTimeout, _ := a.Cfg.GetDuration("gop", "http_idle_timeout", 120*time.Second)
+	maxHeaderBytes, _ := a.Cfg.GetInt("gop", "http_max_header_bytes", http.DefaultMaxHeaderBytes)
+	maxStreams, _ := a.Cfg.GetInt("gop", "http2_max_concurrent_streams", 250)
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(a.http2Enabled())
+	protocols.SetUnencryptedHTTP2(h2c)
+	return &http.Server{
+		Protocols:         protocols,
+		HTTP2:             &http.HTTP2Config{MaxConcurrentStreams: maxStreams},
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+func (a *App) http2Enabled() bool {
+	enabled, _ := a.Cfg.GetBool("gop", "http2_enable", true)
+	return enabled
+}
+
+// e.g. http1_1, http2_0
+func protoStatName(r *http.Request) string {
+	return fmt.Sprintf("http%d_%d", r.ProtoMajor, r.ProtoMinor)
+}
+
+// [max_body_bytes] <route> takes precedence over [gop] max_body_bytes. 0 means no limit.
+func (a *App) maxBodyBytes(routeName string) int64 {
+	limit := a.configInt64("gop", "max_body_bytes", 0)
+	limit = a.configInt64("max_body_bytes", routeName, limit)
+	return limit
+}
+
+func bodyTooLarge(limit int64) error {
+	return HTTPError{
+		Code:      http.StatusRequestEntityTooLarge,
+		Body:      "Request body too large (max " + strconv.FormatInt(limit, 10) + " bytes)",
+		ErrorCode: "body_too_large",
+	}
+}
+
+// Refuse the request if it says its body is over the route's limit, and make sure
+// reading past the limit fails if it doesn't say.
+func (g *Req) limitBody() error {
+	limit := g.app.maxBodyBytes(g.routeName)
+	if limit <= 0 || g.R.Body == nil {
+		return nil
+	}
+	if g.R.ContentLength > limit {
+		g.app.Stats.Inc("http_body_too_large", 1)
+		return bodyTooLarge(limit)
+	}
+	g.R.Body = http.MaxBytesReader(g.W, g.R.Body, limit)
+	return nil
+}
+
+// Turn a failure from reading past the body limit into a 413
+func (g *Req) bodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		g.app.Stats.Inc("http_body_too_large", 1)
+		return bodyTooLarge(maxBytesErr.Limit)
+	}
+	return nil
+}
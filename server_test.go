@@ -0,0 +1,120 @@
+package gop
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestHTTPServerConfig(t *testing.T) {
+	a := newTestApp(t, nil)
+	s := a.httpServer(nil, false)
+	test.Is(t, s.ReadHeaderTimeout, 10*time.Second, "default read header timeout")
+	test.Is(t, s.ReadTimeout, time.Duration(0), "no read timeout by default")
+	test.Is(t, s.WriteTimeout, time.Duration(0), "no write timeout by default")
+	test.Is(t, s.IdleTimeout, 120*time.Second, "default idle timeout")
+	test.Is(t, s.MaxHeaderBytes, http.DefaultMaxHeaderBytes, "default max header bytes")
+
+	a = newTestApp(t, ConfigMap{"gop": {
+		"http_read_header_timeout": "1s",
+		"http_read_timeout":        "2s",
+		"http_write_timeout":       "3s",
+		"http_idle_timeout":        "4s",
+		"http_max_header_bytes":    "5000",
+	}})
+	s = a.httpServer(nil, false)
+	test.Is(t, []time.Duration{s.ReadHeaderTimeout, s.ReadTimeout, s.WriteTimeout, s.IdleTimeout},
+		[]time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second}, "configured timeouts")
+	test.Is(t, s.MaxHeaderBytes, 5000, "configured max header bytes")
+}
+
+func TestHTTPReadHeaderTimeout(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"http_read_header_timeout": "100ms"}})
+	addr := serveTestApp(t, a)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A slowloris client, which never finishes its headers
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: gop\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	io.ReadAll(conn)
+	test.OK(t, time.Since(start) < time.Second, "connection dropped at the timeout")
+}
+
+func TestHTTPMaxHeaderBytes(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"http_max_header_bytes": "1024"}})
+	a.HandleFunc("/x", func(g *Req) error {
+		return g.SendText([]byte("ok"))
+	})
+	addr := serveTestApp(t, a)
+	get := func(headerLen int) int {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET /x HTTP/1.1\r\nHost: gop\r\nX-Big: " + strings.Repeat("a", headerLen) + "\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	test.Is(t, get(100), http.StatusOK, "small headers")
+	test.Is(t, get(10000), http.StatusRequestHeaderFieldsTooLarge, "headers over the limit")
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	a := newTestApp(t, ConfigMap{
+		"gop":            {"max_body_bytes": "10"},
+		"max_body_bytes": {"upload": "100"},
+	})
+	ran := false
+	handler := func(g *Req) error {
+		ran = true
+		body, err := io.ReadAll(g.R.Body)
+		if err != nil {
+			return g.bodyError(err)
+		}
+		return g.SendText(body)
+	}
+	a.HandleFunc("/echo", handler)
+	a.HandleFunc("/upload", handler)
+	a.HandleFunc("/form", func(g *Req) error {
+		return g.SendText([]byte(g.R.FormValue("a")))
+	})
+	post := func(url, body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		return doRequestFrom(a, r)
+	}
+
+	test.Is(t, post("/echo", "0123456789", false).Body.String(), "0123456789", "body at the limit")
+	ran = false
+	w := post("/echo", "0123456789a", false)
+	test.Is(t, w.Code, http.StatusRequestEntityTooLarge, "Content-Length over the limit")
+	test.Is(t, ran, false, "refused before the handler runs")
+	test.OK(t, hasStat(a, "http_body_too_large:1|c"), "counted")
+
+	test.Is(t, post("/echo", "0123456789a", true).Code, http.StatusRequestEntityTooLarge, "reading past the limit")
+	test.Is(t, post("/upload", strings.Repeat("a", 100), false).Code, http.StatusOK, "per-route limit")
+	test.Is(t, post("/upload", strings.Repeat("a", 101), true).Code, http.StatusRequestEntityTooLarge, "over the per-route limit")
+
+	r := httptest.NewRequest("POST", "/form", strings.NewReader("a=0123456789"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ContentLength = -1
+	test.Is(t, doRequestFrom(a, r).Code, http.StatusRequestEntityTooLarge, "form over the limit")
+}
@@ -0,0 +1,220 @@
+package gop
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rolling per-route availability and latency SLOs, configured in the [slo] section.
+// A request counts against availability if it returns a 5xx, and against latency
+// if it takes longer than the latency threshold. WebSockets and event streams last as
+// long as the client likes, so only count towards availability.
+
+const sloBucketsPerWindow = 60
+
+type sloBucket struct {
+	start  time.Time
+	total  int64
+	errors int64
+	timed  int64 // requests counting towards latency
+	slow   int64
+}
+
+// One more bucket than the window needs: the oldest is only partly in the window
+type routeSLO struct {
+	buckets [sloBucketsPerWindow + 1]sloBucket
+}
+
+type sloTracker struct {
+	sync.Mutex
+	app    *App
+	routes map[string]*routeSLO
+}
+
+type sloConfig struct {
+	AvailabilityTarget float64 // percent
+	LatencyTarget      float64 // percent
+	LatencyThreshold   time.Duration
+	Window             time.Duration
+}
+
+// What we report at /gop/slo
+type SLOStatus struct {
+	Route                  string
+	WindowSecs             float64
+	Requests               int64
+	Errors                 int64
+	TimedRequests          int64 // those counting towards latency
+	SlowRequests           int64
+	Availability           float64 // percent
+	AvailabilityTarget     float64
+	AvailabilityBurnRate   float64
+	LatencyThresholdSecs   float64
+	LatencyCompliance      float64 // percent
+	LatencyTarget          float64
+	LatencyBurnRate        float64
+	ErrorBudgetRemaining   float64 // fraction of the availability budget left in the window
+	LatencyBudgetRemaining float64
+}
+
+func (a *App) initSLO() {
+	a.slo = &sloTracker{
+		app:    a,
+		routes: make(map[string]*routeSLO),
+	}
+}
+
+// Route-specific settings are keyed "<route>.<option>" and fall back to the plain option
+func (t *sloTracker) config(routeName string) sloConfig {
+	cfg := &t.app.Cfg
+	getFloat := func(option string, defaultValue float64) float64 {
+		v := t.app.configFloat("slo", option, defaultValue)
+		return t.app.configFloat("slo", routeName+"."+option, v)
+	}
+	getDuration := func(option string, defaultValue time.Duration) time.Duration {
+		v, _ := cfg.GetDuration("slo", option, defaultValue)
+		v, _ = cfg.GetDuration("slo", routeName+"."+option, v)
+		return v
+	}
+	sloCfg := sloConfig{
+		AvailabilityTarget: getFloat("availability_target", 99.9),
+		LatencyTarget:      getFloat("latency_target", 99),
+		LatencyThreshold:   getDuration("latency_threshold", 500*time.Millisecond),
+		Window:             getDuration("window", time.Hour),
+	}
+	if sloCfg.Window < time.Minute {
+		sloCfg.Window = time.Minute
+	}
+	return sloCfg
+}
+
+func (t *sloTracker) enabled() bool {
+	enabled := t.app.configBool("slo", "enable", false)
+	return enabled
+}
+
+// Called from Req.finished()
+func (t *sloTracker) record(routeName string, code int, dur time.Duration, longLived bool) {
+	if !t.enabled() {
+		return
+	}
+	cfg := t.config(routeName)
+	now := time.Now()
+
+	t.Lock()
+	defer t.Unlock()
+	r, ok := t.routes[routeName]
+	if !ok {
+		r = &routeSLO{}
+		t.routes[routeName] = r
+	}
+	b := r.bucket(now, cfg.Window)
+	b.total++
+	if code >= 500 {
+		b.errors++
+	}
+	if longLived {
+		return
+	}
+	b.timed++
+	if dur > cfg.LatencyThreshold {
+		b.slow++
+	}
+}
+
+func (r *routeSLO) bucket(now time.Time, window time.Duration) *sloBucket {
+	bucketLen := window / sloBucketsPerWindow
+	start := now.Truncate(bucketLen)
+	b := &r.buckets[(start.UnixNano()/int64(bucketLen))%int64(len(r.buckets))]
+	if !b.start.Equal(start) {
+		*b = sloBucket{start: start}
+	}
+	return b
+}
+
+func burnRate(badFraction, targetPercent float64) float64 {
+	budget := 1 - targetPercent/100
+	if budget <= 0 {
+		return 0
+	}
+	return badFraction / budget
+}
+
+func (t *sloTracker) status() []SLOStatus {
+	return t.statusAt(time.Now())
+}
+
+func (t *sloTracker) statusAt(now time.Time) []SLOStatus {
+	t.Lock()
+	defer t.Unlock()
+
+	statuses := make([]SLOStatus, 0, len(t.routes))
+	for routeName, r := range t.routes {
+		cfg := t.config(routeName)
+		status := SLOStatus{
+			Route:                routeName,
+			WindowSecs:           cfg.Window.Seconds(),
+			AvailabilityTarget:   cfg.AvailabilityTarget,
+			LatencyTarget:        cfg.LatencyTarget,
+			LatencyThresholdSecs: cfg.LatencyThreshold.Seconds(),
+			Availability:         100,
+			LatencyCompliance:    100,
+		}
+		windowStart := now.Add(-cfg.Window)
+		bucketLen := cfg.Window / sloBucketsPerWindow
+		for _, b := range r.buckets {
+			// Any bucket that overlaps the window
+			if b.start.Add(bucketLen).After(windowStart) && !b.start.After(now) {
+				status.Requests += b.total
+				status.Errors += b.errors
+				status.TimedRequests += b.timed
+				status.SlowRequests += b.slow
+			}
+		}
+		if status.Requests > 0 {
+			errorFraction := float64(status.Errors) / float64(status.Requests)
+			status.Availability = 100 * (1 - errorFraction)
+			status.AvailabilityBurnRate = burnRate(errorFraction, cfg.AvailabilityTarget)
+		}
+		if status.TimedRequests > 0 {
+			slowFraction := float64(status.SlowRequests) / float64(status.TimedRequests)
+			status.LatencyCompliance = 100 * (1 - slowFraction)
+			status.LatencyBurnRate = burnRate(slowFraction, cfg.LatencyTarget)
+		}
+		status.ErrorBudgetRemaining = 1 - status.AvailabilityBurnRate
+		status.LatencyBudgetRemaining = 1 - status.LatencyBurnRate
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	return statuses
+}
+
+// Statsd only takes integer gauges, so we send percentages and burn rates x1000
+func (t *sloTracker) sendGauges() {
+	if !t.enabled() {
+		return
+	}
+	for _, status := range t.status() {
+		prefix := "slo." + status.Route + "."
+		t.app.Stats.Gauge(prefix+"availability_milli", int64(status.Availability*1000))
+		t.app.Stats.Gauge(prefix+"availability_burn_rate_milli", int64(status.AvailabilityBurnRate*1000))
+		t.app.Stats.Gauge(prefix+"latency_compliance_milli", int64(status.LatencyCompliance*1000))
+		t.app.Stats.Gauge(prefix+"latency_burn_rate_milli", int64(status.LatencyBurnRate*1000))
+	}
+}
+
+func (t *sloTracker) reporter() {
+	for {
+		gaugeSecs := t.app.configInt("slo", "gauge_secs", 10)
+		if gaugeSecs < 1 {
+			gaugeSecs = 1
+		}
+		time.Sleep(time.Second * time.Duration(gaugeSecs))
+		t.sendGauges()
+	}
+}
+
+func handleSLO(g *Req) error {
+	return g.SendJson("slo", g.app.slo.status())
+}
@@ -0,0 +1,134 @@
+package gop
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func sloFor(a *App, route string) SLOStatus {
+	for _, status := range a.slo.status() {
+		if status.Route == route {
+			return status
+		}
+	}
+	return SLOStatus{}
+}
+
+func TestSLORecording(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"slo": {
+		"enable":                 "true",
+		"latency_threshold":      "50ms",
+		"slow.latency_threshold": "500ms",
+		"availability_target":    "87.5",
+		"latency_target":         "50",
+	}})
+	a.HandleFunc("/fast", func(g *Req) error {
+		return g.SendText([]byte("ok"))
+	})
+	a.HandleFunc("/sometimes_slow", func(g *Req) error {
+		if g.R.FormValue("slow") != "" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return g.SendText([]byte("ok"))
+	})
+	a.HandleFunc("/slow", func(g *Req) error {
+		time.Sleep(100 * time.Millisecond)
+		return g.SendText([]byte("ok"))
+	})
+	a.HandleFunc("/fails", func(g *Req) error {
+		if g.R.FormValue("fail") != "" {
+			return ServerError("failed")
+		}
+		return g.SendText([]byte("ok"))
+	})
+	a.HandleFunc("/stream", func(g *Req) error {
+		stream, err := g.SSE()
+		if err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		return stream.Send(SSEEvent{Data: "done"})
+	}).Streaming()
+
+	for i := 0; i < 3; i++ {
+		doRequest(a, "GET", "/fast", nil, nil)
+		doRequest(a, "GET", "/sometimes_slow", nil, nil)
+		doRequest(a, "GET", "/fails", nil, nil)
+	}
+	doRequest(a, "GET", "/sometimes_slow?slow=1", nil, nil)
+	doRequest(a, "GET", "/slow", nil, nil)
+	test.Is(t, doRequest(a, "GET", "/fails?fail=1", nil, nil).Code, http.StatusInternalServerError, "failure")
+	doRequest(a, "GET", "/stream", nil, nil)
+	waitRetired(a)
+
+	fast := sloFor(a, "fast")
+	test.Is(t, fast.Requests, int64(3), "fast requests")
+	test.Is(t, fast.Availability, 100.0, "fast availability")
+	test.Is(t, fast.LatencyCompliance, 100.0, "fast latency")
+	test.Is(t, fast.ErrorBudgetRemaining, 1.0, "fast error budget")
+
+	sometimesSlow := sloFor(a, "sometimes_slow")
+	test.Is(t, sometimesSlow.SlowRequests, int64(1), "slow requests")
+	test.Is(t, sometimesSlow.LatencyCompliance, 75.0, "latency compliance")
+	test.Is(t, sometimesSlow.LatencyBurnRate, 0.5, "latency burn rate")
+
+	test.Is(t, sloFor(a, "slow").SlowRequests, int64(0), "per-route latency threshold")
+
+	fails := sloFor(a, "fails")
+	test.Is(t, fails.Errors, int64(1), "errors")
+	test.Is(t, fails.Availability, 75.0, "availability")
+	test.Is(t, fails.AvailabilityBurnRate, 2.0, "availability burn rate")
+	test.Is(t, fails.ErrorBudgetRemaining, -1.0, "error budget overspent")
+
+	stream := sloFor(a, "stream")
+	test.Is(t, stream.Requests, int64(1), "stream counts towards availability")
+	test.Is(t, stream.TimedRequests, int64(0), "stream doesn't count towards latency")
+	test.Is(t, stream.LatencyCompliance, 100.0, "stream latency")
+}
+
+func TestSLOWindow(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"slo": {"enable": "true", "window": "1m"}})
+	now := time.Date(2026, 1, 1, 12, 0, 30, 500*int(time.Millisecond), time.UTC)
+	r := &routeSLO{}
+	a.slo.routes["r"] = r
+	add := func(at time.Time, n int64) {
+		b := r.bucket(at, time.Minute)
+		b.total += n
+		b.timed += n
+	}
+	add(now, 1)
+	add(now.Add(-30*time.Second), 10)
+	// Started before the window, but partly in it
+	add(now.Add(-time.Minute), 100)
+	status := a.slo.statusAt(now)
+	test.Is(t, status[0].Requests, int64(111), "buckets overlapping the window")
+
+	// A minute later only the newest is left
+	status = a.slo.statusAt(now.Add(time.Minute))
+	test.Is(t, status[0].Requests, int64(1), "buckets after a minute")
+	status = a.slo.statusAt(now.Add(2 * time.Minute))
+	test.Is(t, status[0].Requests, int64(0), "buckets after two minutes")
+	test.Is(t, status[0].Availability, 100.0, "availability with no requests")
+}
+
+func TestSLOGauges(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"slo": {"enable": "true", "gauge_secs": "0"}})
+	a.HandleFunc("/fast", func(g *Req) error {
+		return g.SendText([]byte("ok"))
+	})
+	doRequest(a, "GET", "/fast", nil, nil)
+	waitRetired(a)
+	go a.slo.reporter()
+	time.Sleep(1500 * time.Millisecond)
+	sent := 0
+	for _, line := range sentStats(a) {
+		if strings.HasPrefix(line, "slo.fast.availability_milli:100000|g") {
+			sent++
+		}
+	}
+	test.OK(t, sent >= 1 && sent <= 2, "gauges sent once a second, not continuously")
+}
@@ -0,0 +1,186 @@
+package gop
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server-Sent Events. g.SSE() sends the headers and returns a stream to send events on.
+// A comment is sent every sse_heartbeat_interval to keep proxies from dropping the
+// connection. The stream ends when the handler returns or the client goes away - watch
+// Done(). SSE requests aren't logged as slow and show as Kind "sse" in /gop/status; mark
+// their routes with Route.Streaming() so request_timeout doesn't cut them off.
+
+var ErrStreamClosed = errors.New("event stream closed")
+
+type SSEEvent struct {
+	ID    string // sent back by the client as Last-Event-ID when it reconnects
+	Event string // the event type, "message" if empty
+	Data  string // may have newlines
+	Retry time.Duration
+}
+
+type SSEStream struct {
+	g      *Req
+	lock   sync.Mutex
+	closed bool
+	stop   chan struct{}
+}
+
+// Start an event stream. Call before writing anything else.
+func (g *Req) SSE() (*SSEStream, error) {
+	if g.stream != nil {
+		return g.stream, nil
+	}
+	g.kind.Store("sse")
+	g.CanBeSlow = true
+
+	g.W.lock.Lock()
+	// Compression would hold events back until its buffer filled
+	g.W.compress = nil
+	g.W.lock.Unlock()
+	// Nor should the server's write timeout end the stream
+	http.NewResponseController(g.W.ResponseWriter).SetWriteDeadline(time.Time{})
+
+	h := g.W.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	if g.R.ProtoMajor == 1 {
+		h.Set("Connection", "keep-alive")
+	}
+	g.W.WriteHeader(http.StatusOK)
+
+	s := &SSEStream{g: g, stop: make(chan struct{})}
+	g.stream = s
+	g.app.Stats.Inc("sse.opened", 1)
+
+	retry, _ := g.Cfg.GetDuration("gop", "sse_retry", 0)
+	var err error
+	if retry > 0 {
+		err = s.Send(SSEEvent{Retry: retry})
+	} else {
+		err = s.write(": connected\n\n")
+	}
+	if err != nil {
+		return nil, err
+	}
+	heartbeat, _ := g.Cfg.GetDuration("gop", "sse_heartbeat_interval", 15*time.Second)
+	if heartbeat > 0 {
+		go s.heartbeat(heartbeat)
+	}
+	return s, nil
+}
+
+// The id of the last event the client saw, if it is reconnecting
+func (s *SSEStream) LastEventID() string {
+	return s.g.R.Header.Get("Last-Event-ID")
+}
+
+// Closed when the client goes away (or the request times out)
+func (s *SSEStream) Done() <-chan struct{} {
+	return s.g.Context().Done()
+}
+
+func (s *SSEStream) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.Done():
+			return
+		case <-ticker.C:
+			if s.write(": heartbeat\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// Write and flush, unless the stream has ended
+func (s *SSEStream) write(text string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if err := s.g.Context().Err(); err != nil {
+		return err
+	}
+	_, err := s.g.W.Write([]byte(text))
+	if err != nil {
+		return err
+	}
+	s.g.W.Flush()
+	return nil
+}
+
+// Newlines would end the field early
+func sseField(name, value string) string {
+	return name + ": " + strings.NewReplacer("\r", "", "\n", "").Replace(value) + "\n"
+}
+
+func (s *SSEStream) Send(event SSEEvent) error {
+	var b strings.Builder
+	if event.ID != "" {
+		b.WriteString(sseField("id", event.ID))
+	}
+	if event.Event != "" {
+		b.WriteString(sseField("event", event.Event))
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	if event.Data != "" || event.Event != "" || event.ID != "" {
+		// Clients end a line at CR, LF or CRLF, so a lone CR must start a new data line
+		// too, or the rest of the line would be read as a field of its own
+		data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(event.Data)
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	err := s.write(b.String())
+	if err == nil && event.Data != "" {
+		s.g.app.Stats.Inc("sse.events", 1)
+	}
+	return err
+}
+
+// Send a message event with v as JSON
+func (s *SSEStream) SendJSON(event, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(SSEEvent{ID: id, Event: event, Data: string(data)})
+}
+
+// A comment, ignored by clients
+func (s *SSEStream) Comment(text string) error {
+	text = strings.NewReplacer("\r", "", "\n", "").Replace(text)
+	return s.write(": " + text + "\n\n")
+}
+
+// Stop the stream. Called when the handler returns; nothing can be sent afterwards.
+func (s *SSEStream) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+}
+
+func (g *Req) closeStream() {
+	if g.stream != nil {
+		g.stream.Close()
+	}
+}
@@ -0,0 +1,92 @@
+package gop
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestSSEEvents(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {
+		"compress_enable":        "true",
+		"compress_min_bytes":     "1",
+		"sse_retry":              "2s",
+		"sse_heartbeat_interval": "0",
+	}})
+	var stream *SSEStream
+	a.HandleFunc("/events", func(g *Req) error {
+		var err error
+		stream, err = g.SSE()
+		if err != nil {
+			return err
+		}
+		test.Is(t, stream.LastEventID(), "41", "Last-Event-ID")
+		stream.Send(SSEEvent{ID: "42", Event: "update", Data: "line one\r\nline two"})
+		stream.Send(SSEEvent{Data: "plain"})
+		stream.Send(SSEEvent{ID: "4\n3", Data: "no field injection"})
+		stream.Send(SSEEvent{Data: "lone\revent: injected"})
+		stream.SendJSON("json", "", map[string]int{"n": 1})
+		stream.Comment("just\nsaying")
+		return nil
+	}).Streaming()
+
+	w := doRequest(a, "GET", "/events", nil, map[string]string{"Last-Event-ID": "41", "Accept-Encoding": "gzip"})
+	test.Is(t, w.Header().Get("Content-Type"), "text/event-stream; charset=utf-8", "content type")
+	test.Is(t, w.Header().Get("Cache-Control"), "no-cache", "not cached")
+	test.Is(t, w.Header().Get("Content-Encoding"), "", "not compressed")
+	test.Is(t, w.Body.String(), "retry: 2000\n\n"+
+		"id: 42\nevent: update\ndata: line one\ndata: line two\n\n"+
+		"data: plain\n\n"+
+		"id: 43\ndata: no field injection\n\n"+
+		"data: lone\ndata: event: injected\n\n"+
+		"event: json\ndata: {\"n\":1}\n\n"+
+		": justsaying\n\n", "events")
+	test.OK(t, hasStat(a, "sse.opened:1|c"), "stream counted")
+	test.OK(t, hasStat(a, "sse.events:1|c"), "events counted")
+	test.Is(t, stream.Send(SSEEvent{Data: "late"}), ErrStreamClosed, "nothing sent after the handler returns")
+}
+
+func TestSSEHeartbeatAndClientGone(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"sse_heartbeat_interval": "50ms"}})
+	gone := make(chan error, 1)
+	kind := make(chan string, 1)
+	a.HandleFunc("/events", func(g *Req) error {
+		stream, err := g.SSE()
+		if err != nil {
+			return err
+		}
+		kind <- g.Kind()
+		select {
+		case <-stream.Done():
+		case <-time.After(3 * time.Second):
+		}
+		gone <- stream.Send(SSEEvent{Data: "too late"})
+		return nil
+	}).Streaming()
+	addr := serveTestApp(t, a)
+
+	resp, err := http.Get("http://" + addr + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Is(t, <-kind, "sse", "kind")
+	r := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 4 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "\n" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	test.Is(t, lines, []string{": connected", ": heartbeat", ": heartbeat", ": heartbeat"}, "heartbeats")
+
+	resp.Body.Close()
+	test.OK(t, <-gone != nil, "client going away ends the stream")
+}
@@ -1,15 +1,28 @@
 package gop
 
 import (
+	"fmt"
 	"github.com/cactus/go-statsd-client/statsd"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type StatsdClient struct {
 	client *statsd.Client
 	rate   float32
 	app    *App
+	// Only set on the per-request client (Req.Stats)
+	prefix string
+	counts *statCounts
+}
+
+// Per-request Inc/Dec totals, so we can summarise them in the access log and /gop/status
+type statCounts struct {
+	sync.Mutex
+	m map[string]int64
 }
 
 func (a *App) initStatsd() {
@@ -34,25 +47,124 @@ func (a *App) initStatsd() {
 
 func (s *StatsdClient) Dec(stat string, value int64) {
 	s.app.Debug("STATSD DEC %s %d", stat, value)
-	_ = s.client.Dec(stat, value, s.rate)
+	s.count(stat, -value)
+	_ = s.client.Dec(s.scoped(stat), value, s.rate)
 }
 
 func (s *StatsdClient) Gauge(stat string, value int64) {
 	s.app.Debug("STATSD GAUGE %s %d", stat, value)
-	_ = s.client.Gauge(stat, value, s.rate)
+	_ = s.client.Gauge(s.scoped(stat), value, s.rate)
 }
 
 func (s *StatsdClient) GaugeDelta(stat string, value int64) {
 	s.app.Debug("STATSD GAUGEDELTA %s %d", stat, value)
-	_ = s.client.GaugeDelta(stat, value, s.rate)
+	_ = s.client.GaugeDelta(s.scoped(stat), value, s.rate)
 }
 
 func (s *StatsdClient) Inc(stat string, value int64) {
 	s.app.Debug("STATSD INC %s %d", stat, value)
-	_ = s.client.Inc(stat, value, s.rate)
+	s.count(stat, value)
+	_ = s.client.Inc(s.scoped(stat), value, s.rate)
 }
 
 func (s *StatsdClient) Timing(stat string, delta int64) {
 	s.app.Debug("STATSD TIMING %s %d", stat, delta)
-	_ = s.client.Timing(stat, delta, s.rate)
+	_ = s.client.Timing(s.scoped(stat), delta, s.rate)
+}
+
+// Unique count of values per flush (e.g. distinct users)
+func (s *StatsdClient) Set(stat string, value string) {
+	s.app.Debug("STATSD SET %s %s", stat, value)
+	_ = s.client.Set(s.scoped(stat), value, s.rate)
+}
+
+func (s *StatsdClient) Histogram(stat string, value int64) {
+	s.app.Debug("STATSD HISTOGRAM %s %d", stat, value)
+	_ = s.client.Raw(s.scoped(stat), fmt.Sprintf("%d|h", value), s.rate)
+}
+
+// Distribution is the server-side aggregated variant of Histogram (not supported by all statsd servers)
+func (s *StatsdClient) Distribution(stat string, value int64) {
+	s.app.Debug("STATSD DISTRIBUTION %s %d", stat, value)
+	_ = s.client.Raw(s.scoped(stat), fmt.Sprintf("%d|d", value), s.rate)
+}
+
+// Start a timer, call the returned func to record the timing in millisecs. Typically:
+//
+//	defer g.Stats.Time("db.query")()
+func (s *StatsdClient) Time(stat string) func() {
+	start := time.Now()
+	return func() {
+		s.Timing(stat, int64(time.Since(start)/time.Millisecond))
+	}
+}
+
+// Get a client which uses the given sample rate instead of statsd_rate, e.g.
+//
+//	g.Stats.WithRate(0.1).Inc("cache.hit", 1)
+func (s *StatsdClient) WithRate(rate float32) *StatsdClient {
+	rated := *s
+	rated.rate = rate
+	return &rated
+}
+
+// Get a client for a single request. Inc/Dec are also totalled for the request. With
+// statsd_route_prefix, stats are sent under route.<routeName>.
+func (s *StatsdClient) forRoute(routeName string) StatsdClient {
+	scoped := *s
+	if s.app != nil {
+		if s.app.configBool("gop", "statsd_route_prefix", false) {
+			scoped.prefix = "route." + routeName
+		}
+	}
+	scoped.counts = &statCounts{m: make(map[string]int64)}
+	return scoped
+}
+
+func (s *StatsdClient) scoped(stat string) string {
+	if s.prefix == "" {
+		return stat
+	}
+	return s.prefix + "." + stat
+}
+
+func (s *StatsdClient) count(stat string, value int64) {
+	if s.counts == nil {
+		return
+	}
+	s.counts.Lock()
+	s.counts.m[stat] += value
+	s.counts.Unlock()
+}
+
+// Get a copy of the per-request Inc/Dec totals. Empty for the app-wide client.
+func (s *StatsdClient) Counts() map[string]int64 {
+	counts := make(map[string]int64)
+	if s.counts == nil {
+		return counts
+	}
+	s.counts.Lock()
+	defer s.counts.Unlock()
+	for k, v := range s.counts.m {
+		counts[k] = v
+	}
+	return counts
+}
+
+// Counts formatted as "k=v,k=v" (sorted), or "-" if there are none
+func (s *StatsdClient) countsSummary() string {
+	counts := s.Counts()
+	if len(counts) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", k, counts[k])
+	}
+	return strings.Join(parts, ",")
 }
@@ -0,0 +1,90 @@
+package gop
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestStatsTypes(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.Stats.Set("users", "alice")
+	a.Stats.Histogram("size", 12)
+	a.Stats.Distribution("latency", 34)
+	a.Stats.GaugeDelta("level", -2)
+	done := a.Stats.Time("work")
+	time.Sleep(20 * time.Millisecond)
+	done()
+
+	test.OK(t, hasStat(a, "users:alice|s"), "set")
+	test.OK(t, hasStat(a, "size:12|h"), "histogram")
+	test.OK(t, hasStat(a, "latency:34|d"), "distribution")
+	test.OK(t, hasStat(a, "level:-2|g"), "gauge delta")
+	timed := false
+	for _, line := range sentStats(a) {
+		if strings.HasPrefix(line, "work:") && strings.HasSuffix(line, "|ms") {
+			timed = line != "work:0|ms"
+		}
+	}
+	test.OK(t, timed, "timer")
+
+	rated := a.Stats.WithRate(0.25)
+	test.Is(t, rated.rate, float32(0.25), "WithRate")
+	test.Is(t, a.Stats.rate, float32(1.0), "WithRate leaves the original alone")
+}
+
+func newRouteStatsApp(t *testing.T, cfg map[string]string) *App {
+	a := newTestApp(t, ConfigMap{"gop": cfg})
+	a.HandleFunc("/orders/{id}", func(g *Req) error {
+		g.Stats.Inc("db.calls", 1)
+		g.Stats.Inc("db.calls", 2)
+		g.Stats.Inc("cache.hits", 1)
+		g.Stats.Dec("cache.hits", 1)
+		g.Stats.Gauge("basket", 5)
+		return g.SendText([]byte(g.Stats.countsSummary()))
+	})
+	return a
+}
+
+func TestRouteStats(t *testing.T) {
+	a := newRouteStatsApp(t, nil)
+	accessLog, err := os.Create(a.logDir + "/access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.accessLog = accessLog
+
+	w := doRequest(a, "GET", "/orders/3", nil, nil)
+	test.Is(t, w.Body.String(), "cache.hits=0,db.calls=3", "per-request counts")
+	waitRetired(a)
+
+	// Same names as the app-wide client unless statsd_route_prefix is set
+	test.OK(t, hasStat(a, "db.calls:2|c"), "handler stat name unchanged")
+	test.OK(t, hasStat(a, "basket:5|g"), "handler gauge name unchanged")
+	test.OK(t, !hasStat(a, "route."), "no route prefix")
+
+	logged, _ := os.ReadFile(a.logDir + "/access.log")
+	test.OK(t, strings.Contains(string(logged), "cache.hits=0,db.calls=3"), "counts in the access log: "+string(logged))
+
+	// Each request has its own counts
+	w = doRequest(a, "GET", "/orders/4", nil, nil)
+	test.Is(t, w.Body.String(), "cache.hits=0,db.calls=3", "counts are per request")
+	test.Is(t, a.Stats.countsSummary(), "-", "app-wide client has no counts")
+}
+
+func TestRouteStatsPrefix(t *testing.T) {
+	a := newRouteStatsApp(t, map[string]string{"statsd_route_prefix": "true"})
+	doRequest(a, "GET", "/orders/3", nil, nil)
+	test.OK(t, hasStat(a, "route.orders_id.db.calls:2|c"), "handler stat under the route")
+	test.OK(t, hasStat(a, "route.orders_id.basket:5|g"), "handler gauge under the route")
+	test.OK(t, hasStat(a, "http_status.200:1|c"), "app stats unprefixed")
+}
+
+func TestRouteStatsPrefixBadValue(t *testing.T) {
+	a := newRouteStatsApp(t, map[string]string{"statsd_route_prefix": "sometimes"})
+	test.Is(t, doRequest(a, "GET", "/orders/3", nil, nil).Code, 200, "request served")
+	test.OK(t, hasStat(a, "db.calls:2|c"), "default of no prefix used")
+}
@@ -0,0 +1,190 @@
+package gop
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS termination. tls_cert_file and tls_key_file are matching comma-separated lists;
+// with more than one pair the cert is picked by SNI, the first being the default.
+// The files are re-read when they change (checked every tls_reload_secs) or on SIGHUP.
+// New handshakes get the new certs; existing connections are untouched.
+
+type certStore struct {
+	sync.RWMutex
+	app       *App
+	certs     []*tls.Certificate
+	clientCAs *x509.CertPool
+	crl       crlInfo
+	modTimes  map[string]time.Time
+}
+
+func (a *App) tlsEnabled() bool {
+	certFile, _ := a.Cfg.Get("gop", "tls_cert_file", "")
+	return certFile != ""
+}
+
+func (cs *certStore) files() ([]string, []string, error) {
+	certFiles, _ := cs.app.Cfg.GetList("gop", "tls_cert_file", nil)
+	keyFiles, _ := cs.app.Cfg.GetList("gop", "tls_key_file", nil)
+	if len(certFiles) != len(keyFiles) {
+		return nil, nil, fmt.Errorf("%d tls_cert_file entries but %d tls_key_file entries", len(certFiles), len(keyFiles))
+	}
+	return certFiles, keyFiles, nil
+}
+
+// Load all the cert/key pairs. On error we keep whatever we had.
+func (cs *certStore) load() error {
+	certFiles, keyFiles, err := cs.files()
+	if err != nil {
+		return err
+	}
+	certs := make([]*tls.Certificate, len(certFiles))
+	modTimes := make(map[string]time.Time)
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("can't load %s / %s: %s", certFiles[i], keyFiles[i], err.Error())
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("can't parse %s: %s", certFiles[i], err.Error())
+		}
+		cs.app.Info("Loaded TLS cert %s for %s, expires %s", certFiles[i], cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter)
+		certs[i] = &cert
+		for _, f := range []string{certFiles[i], keyFiles[i]} {
+			modTimes[f] = fileModTime(f)
+		}
+	}
+	clientCAs, crl, err := cs.loadClientAuth(modTimes)
+	if err != nil {
+		return err
+	}
+	cs.Lock()
+	cs.certs = certs
+	cs.clientCAs = clientCAs
+	cs.crl = crl
+	cs.modTimes = modTimes
+	cs.Unlock()
+	return nil
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (cs *certStore) changed() bool {
+	certFiles, keyFiles, err := cs.files()
+	if err != nil {
+		return true
+	}
+	files := append(certFiles, keyFiles...)
+	for _, option := range []string{"tls_client_ca_file", "tls_crl_file"} {
+		if f, _ := cs.app.Cfg.Get("gop", option, ""); f != "" {
+			files = append(files, f)
+		}
+	}
+	cs.RLock()
+	defer cs.RUnlock()
+	for _, f := range files {
+		modTime, ok := cs.modTimes[f]
+		if !ok || !modTime.Equal(fileModTime(f)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *certStore) reload(reason string) {
+	cs.app.Info("Reloading TLS certs: %s", reason)
+	err := cs.load()
+	if err != nil {
+		cs.app.Errorf("Failed to reload TLS certs - keeping the old ones: %s", err.Error())
+		cs.app.Stats.Inc("tls.reload_errors", 1)
+		return
+	}
+	cs.app.Stats.Inc("tls.reloads", 1)
+}
+
+func (cs *certStore) watch() {
+	for {
+		reloadSecs := cs.app.configInt("gop", "tls_reload_secs", 10)
+		if reloadSecs <= 0 {
+			reloadSecs = 60
+		} else if cs.changed() {
+			cs.reload("cert files changed")
+		}
+		time.Sleep(time.Second * time.Duration(reloadSecs))
+	}
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.RLock()
+	defer cs.RUnlock()
+	if len(cs.certs) == 0 {
+		return nil, fmt.Errorf("no TLS certificates loaded")
+	}
+	if hello.ServerName != "" {
+		for _, cert := range cs.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return cs.certs[0], nil
+}
+
+// Called on SIGHUP
+func (a *App) reloadTLS() {
+	if a.tlsEnabled() {
+		a.loadCerts().reload("SIGHUP")
+	}
+}
+
+// Load the certs and start watching them, once, however many listeners want them
+func (a *App) loadCerts() *certStore {
+	a.certsOnce.Do(func() {
+		cs := &certStore{app: a}
+		err := cs.load()
+		if err != nil {
+			a.Fatalln("Can't start TLS: " + err.Error())
+		}
+		a.certs = cs
+		go cs.watch()
+	})
+	return a.certs
+}
+
+func (a *App) tlsConfig() *tls.Config {
+	minVersion := uint16(tls.VersionTLS12)
+	if v, _ := a.Cfg.Get("gop", "tls_min_version", "1.2"); v == "1.3" {
+		minVersion = tls.VersionTLS13
+	}
+	nextProtos := []string{"http/1.1"}
+	if a.http2Enabled() {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	config := &tls.Config{
+		GetCertificate: a.certs.getCertificate,
+		MinVersion:     minVersion,
+		NextProtos:     nextProtos,
+	}
+	config.GetConfigForClient = a.certs.configForClient(config)
+	return config
+}
+
+// Wrap the (raw, handed over by goagain) listener in TLS
+func (a *App) tlsListener(l net.Listener) net.Listener {
+	a.loadCerts()
+	a.Info("Serving TLS on %s", l.Addr())
+	return tls.NewListener(l, a.tlsConfig())
+}
@@ -0,0 +1,153 @@
+package gop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var testSerial int64 = 1
+
+// A cert for cn, signed by parent, or a self-signed CA if parent is nil
+func newTestCert(t *testing.T, cn string, parent *testCert, dnsNames ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.IPAddresses = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Write the cert and key out, returning their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := dir+"/"+name+".crt", dir+"/"+name+".key"
+	if err := os.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// The CN of the cert the server at addr hands out for serverName
+func servedCN(t *testing.T, addr, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func serveTLS(t *testing.T, a *App) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go a.serve(l, a.GorillaRouter, serveOptions{tls: true})
+	return l.Addr().String()
+}
+
+func TestTLSServeAndReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	defaultCert, defaultKey := newTestCert(t, "one", ca, "one.example").write(t, dir, "one")
+	otherCert, otherKey := newTestCert(t, "other", ca, "other.example").write(t, dir, "other")
+	a := newTestApp(t, ConfigMap{"gop": {
+		"tls_cert_file":   defaultCert + "," + otherCert,
+		"tls_key_file":    defaultKey + "," + otherKey,
+		"tls_reload_secs": "1",
+	}})
+	a.HandleFunc("/hello", func(g *Req) error {
+		return g.SendText([]byte("hello"))
+	})
+
+	// Listeners starting together share one cert store
+	addrs := []string{serveTLS(t, a), serveTLS(t, a)}
+	for _, addr := range addrs {
+		test.Is(t, servedCN(t, addr, "one.example"), "one", "cert for default name")
+		test.Is(t, servedCN(t, addr, "other.example"), "other", "cert picked by SNI")
+		test.Is(t, servedCN(t, addr, "unknown.example"), "one", "default cert for unknown name")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + addrs[0] + "/hello")
+	test.ErrIs(t, err, nil, "https request")
+	resp.Body.Close()
+	test.Is(t, resp.StatusCode, http.StatusOK, "https status")
+
+	// SIGHUP reloads
+	newTestCert(t, "two", ca, "one.example").write(t, dir, "one")
+	a.reloadTLS()
+	test.Is(t, servedCN(t, addrs[0], "one.example"), "two", "cert after SIGHUP")
+	test.Is(t, servedCN(t, addrs[1], "one.example"), "two", "cert after SIGHUP on other listener")
+
+	// So does changing the files
+	newTestCert(t, "three", ca, "one.example").write(t, dir, "one")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(defaultCert, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCN(t, addrs[0], "one.example") != "three" && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	test.Is(t, servedCN(t, addrs[0], "one.example"), "three", "cert after the file changed")
+
+	// A bad file keeps the old cert
+	os.WriteFile(defaultCert, []byte("junk"), 0600)
+	a.reloadTLS()
+	test.Is(t, servedCN(t, addrs[0], "one.example"), "three", "cert after a failed reload")
+	test.OK(t, hasStat(a, "tls.reload_errors:"), "failed reload counted")
+}
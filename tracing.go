@@ -0,0 +1,415 @@
+package gop
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C trace context (https://www.w3.org/TR/trace-context/) with spans exported as OTLP/HTTP JSON.
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusUnset = 0
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Name       string
+	Sampled    bool
+	TraceState string
+	kind       int
+	start      time.Time
+	end        time.Time
+	status     int
+	statusMsg  string
+	attributes map[string]interface{}
+	mu         sync.Mutex
+	ended      bool
+	tracer     *tracer
+}
+
+type tracer struct {
+	app         *App
+	enabled     bool
+	spans       chan *Span
+	serviceName string
+}
+
+func (a *App) initTracing() {
+	enabled, _ := a.Cfg.GetBool("gop", "trace_enable", false)
+	a.tracer = &tracer{
+		app:         a,
+		enabled:     enabled,
+		serviceName: a.ProjectName + "." + a.AppName,
+	}
+	if !enabled {
+		return
+	}
+	endpoint, _ := a.Cfg.Get("gop", "trace_otlp_endpoint", "http://localhost:4318/v1/traces")
+	queueLen, _ := a.Cfg.GetInt("gop", "trace_queue_len", 4096)
+	a.tracer.spans = make(chan *Span, queueLen)
+	go a.tracer.exporter(endpoint)
+}
+
+func randomBytes(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		// Should never happen, fall back to something non-crypto
+		for i := range b {
+			b[i] = byte(mathrand.Intn(256))
+		}
+	}
+}
+
+// Parse a W3C traceparent header: version-traceid-parentid-flags
+func parseTraceParent(s string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+	// Version 00 has exactly 4 fields, future versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != 16 || isZero(tid) {
+		return
+	}
+	pid, err := hex.DecodeString(parts[2])
+	if err != nil || len(pid) != 8 || isZero(pid) {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 {
+		return
+	}
+	copy(traceID[:], tid)
+	copy(parentID[:], pid)
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Start the server span for an incoming request, continuing any inbound trace. With
+// tracing off no ids are made up: an inbound trace is passed through as it came.
+func (t *tracer) startServerSpan(r *http.Request, routeName string) *Span {
+	span := &Span{
+		Name:       routeName,
+		kind:       spanKindServer,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+	traceID, parentID, sampled, ok := parseTraceParent(r.Header.Get("traceparent"))
+	if !t.enabled {
+		if ok {
+			span.TraceID, span.SpanID, span.Sampled = traceID, parentID, sampled
+			span.TraceState = r.Header.Get("tracestate")
+		}
+		return span
+	}
+	if ok {
+		span.TraceID = traceID
+		span.ParentID = parentID
+		span.Sampled = sampled
+		span.TraceState = r.Header.Get("tracestate")
+	} else {
+		randomBytes(span.TraceID[:])
+		sampleRate := t.app.configFloat("gop", "trace_sample_rate", 1.0)
+		span.Sampled = mathrand.Float64() < sampleRate
+	}
+	randomBytes(span.SpanID[:])
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.RequestURI())
+	span.SetAttribute("http.route", routeName)
+	return span
+}
+
+// Start a child span. Call End() when done.
+func (s *Span) Child(name string) *Span {
+	child := &Span{
+		TraceID:    s.TraceID,
+		ParentID:   s.SpanID,
+		Name:       name,
+		Sampled:    s.Sampled,
+		TraceState: s.TraceState,
+		kind:       spanKindInternal,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+		tracer:     s.tracer,
+	}
+	if s.tracer.enabled {
+		randomBytes(child.SpanID[:])
+	} else {
+		child.SpanID = s.SpanID
+	}
+	return child
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// Mark the span as failed
+func (s *Span) SetError(msg string) {
+	s.mu.Lock()
+	s.status = spanStatusError
+	s.statusMsg = msg
+	s.mu.Unlock()
+}
+
+// Finish the span and queue it for export. Only the first call has any effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.export(s)
+}
+
+// The W3C traceparent header value for this span, for propagation to outbound calls.
+// Empty if there's no trace.
+func (s *Span) TraceParent() string {
+	if isZero(s.TraceID[:]) {
+		return ""
+	}
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.TraceID[:]), hex.EncodeToString(s.SpanID[:]), flags)
+}
+
+// Set traceparent/tracestate on outbound request headers
+func (s *Span) Inject(h http.Header) {
+	if isZero(s.TraceID[:]) {
+		return
+	}
+	h.Set("traceparent", s.TraceParent())
+	if s.TraceState != "" {
+		h.Set("tracestate", s.TraceState)
+	}
+}
+
+// Start a child span of the request's server span, e.g.
+//
+//	span := g.Span("db.query")
+//	defer span.End()
+func (g *Req) Span(name string) *Span {
+	return g.span.Child(name)
+}
+
+// The server span for this request
+func (g *Req) ServerSpan() *Span {
+	return g.span
+}
+
+func (g *Req) endServerSpan() {
+	g.span.SetAttribute("http.status_code", g.W.code)
+	if g.W.code >= 500 {
+		g.span.SetError(http.StatusText(g.W.code))
+	} else {
+		g.span.mu.Lock()
+		if g.span.status == spanStatusUnset {
+			g.span.status = spanStatusOK
+		}
+		g.span.mu.Unlock()
+	}
+	g.span.End()
+}
+
+func (t *tracer) export(s *Span) {
+	if !t.enabled || !s.Sampled {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.app.Stats.Inc("trace.dropped_spans", 1)
+	}
+}
+
+func (t *tracer) exporter(endpoint string) {
+	batchSize := t.app.configInt("gop", "trace_batch_size", 512)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	flushEvery, _ := t.app.Cfg.GetDuration("gop", "trace_flush_interval", 5*time.Second)
+	if flushEvery < 100*time.Millisecond {
+		t.app.Errorf("trace_flush_interval %s is too short - using 100ms", flushEvery)
+		flushEvery = 100 * time.Millisecond
+	}
+	ticker := time.Tick(flushEvery)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	batch := make([]*Span, 0, batchSize)
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := t.post(client, endpoint, batch)
+		if err != nil {
+			t.app.Errorf("Failed to export %d spans to [%s]: %s", len(batch), endpoint, err.Error())
+			t.app.Stats.Inc("trace.export_errors", 1)
+		} else {
+			t.app.Stats.Inc("trace.exported_spans", int64(len(batch)))
+		}
+		batch = make([]*Span, 0, batchSize)
+	}
+}
+
+// OTLP/HTTP JSON encoding (opentelemetry-proto ExportTraceServiceRequest)
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpValue(v interface{}) otlpAnyValue {
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float32:
+		f := float64(v)
+		return otlpAnyValue{DoubleValue: &f}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.SpanID[:]),
+		TraceState:        s.TraceState,
+		Name:              s.Name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: s.status, Message: s.statusMsg},
+	}
+	if !isZero(s.ParentID[:]) {
+		o.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+	}
+	for k, v := range s.attributes {
+		o.Attributes = append(o.Attributes, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+	return o
+}
+
+func (t *tracer) post(client *http.Client, endpoint string, batch []*Span) error {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = "github.com/trendmicro/gop"
+	for _, span := range batch {
+		scopeSpans.Spans = append(scopeSpans.Spans, span.toOTLP())
+	}
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{
+		{Key: "service.name", Value: otlpValue(t.serviceName)},
+	}
+	body, err := json.Marshal(otlpExportRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
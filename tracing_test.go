@@ -0,0 +1,199 @@
+package gop
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// An OTLP collector that hands on the spans it is sent
+func fakeCollector(t *testing.T) (*httptest.Server, chan otlpResourceSpans) {
+	received := make(chan otlpResourceSpans, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var req otlpExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rs := range req.ResourceSpans {
+			received <- rs
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+// Wait for n spans to reach the collector
+func collectSpans(t *testing.T, received chan otlpResourceSpans, n int) ([]otlpSpan, otlpResourceSpans) {
+	var spans []otlpSpan
+	var rs otlpResourceSpans
+	timeout := time.After(5 * time.Second)
+	for len(spans) < n {
+		select {
+		case rs = <-received:
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		case <-timeout:
+			t.Fatalf("collector got %d spans, wanted %d", len(spans), n)
+		}
+	}
+	return spans, rs
+}
+
+func spanAttr(s otlpSpan, key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			switch {
+			case kv.Value.StringValue != nil:
+				return *kv.Value.StringValue
+			case kv.Value.IntValue != nil:
+				return *kv.Value.IntValue
+			}
+		}
+	}
+	return ""
+}
+
+func TestTracingExport(t *testing.T) {
+	collector, received := fakeCollector(t)
+	var downstreamParent string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamParent = r.Header.Get("traceparent")
+	}))
+	defer downstream.Close()
+
+	a := newTestApp(t, ConfigMap{"gop": {
+		"trace_enable":         "true",
+		"trace_otlp_endpoint":  collector.URL + "/v1/traces",
+		"trace_flush_interval": "0s", // too short, so 100ms
+	}})
+	a.HandleFunc("/traced", func(g *Req) error {
+		span := g.Span("downstream")
+		defer span.End()
+		req, _ := http.NewRequest("GET", downstream.URL, nil)
+		span.Inject(req.Header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return g.SendText([]byte("ok"))
+	})
+
+	traceID, callerID := "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	w := doRequest(a, "GET", "/traced", nil, map[string]string{
+		"traceparent": "00-" + traceID + "-" + callerID + "-01",
+		"tracestate":  "vendor=x",
+	})
+	test.Is(t, w.Code, http.StatusOK, "status")
+
+	spans, rs := collectSpans(t, received, 2)
+	test.Is(t, len(rs.Resource.Attributes), 1, "resource attributes")
+	test.Is(t, rs.Resource.Attributes[0].Key, "service.name", "resource attribute")
+	test.Is(t, *rs.Resource.Attributes[0].Value.StringValue, "test.app", "service name")
+	test.Is(t, rs.ScopeSpans[0].Scope.Name, "github.com/trendmicro/gop", "scope")
+
+	var server, child otlpSpan
+	for _, s := range spans {
+		if s.Kind == spanKindServer {
+			server = s
+		} else {
+			child = s
+		}
+	}
+	test.Is(t, server.Name, "traced", "server span name")
+	test.Is(t, server.TraceID, traceID, "server span continues the inbound trace")
+	test.Is(t, server.ParentSpanID, callerID, "server span's parent is the caller")
+	test.Is(t, server.TraceState, "vendor=x", "tracestate kept")
+	test.Is(t, len(server.SpanID), 16, "server span id")
+	test.Is(t, server.Status.Code, spanStatusOK, "server span status")
+	test.Is(t, spanAttr(server, "http.method"), "GET", "http.method")
+	test.Is(t, spanAttr(server, "http.route"), "traced", "http.route")
+	test.Is(t, spanAttr(server, "http.status_code"), "200", "http.status_code")
+	test.OK(t, server.StartTimeUnixNano <= server.EndTimeUnixNano, "server span times")
+
+	test.Is(t, child.Name, "downstream", "child span name")
+	test.Is(t, child.Kind, spanKindInternal, "child span kind")
+	test.Is(t, child.TraceID, traceID, "child span trace")
+	test.Is(t, child.ParentSpanID, server.SpanID, "child span's parent")
+	test.Is(t, downstreamParent, "00-"+traceID+"-"+child.SpanID+"-01", "traceparent sent downstream")
+	test.OK(t, hasStat(a, "trace.exported_spans:"), "exported spans counted")
+}
+
+func TestTracingNewTraceAndErrors(t *testing.T) {
+	collector, received := fakeCollector(t)
+	a := newTestApp(t, ConfigMap{"gop": {
+		"trace_enable":         "true",
+		"trace_otlp_endpoint":  collector.URL + "/v1/traces",
+		"trace_flush_interval": "100ms",
+	}})
+	a.HandleFunc("/fails", func(g *Req) error {
+		g.W.WriteHeader(http.StatusBadGateway)
+		return nil
+	})
+	doRequest(a, "GET", "/fails", nil, map[string]string{"traceparent": "00-not-a-traceparent"})
+
+	spans, _ := collectSpans(t, received, 1)
+	test.Is(t, len(spans[0].TraceID), 32, "new trace id")
+	test.Is(t, spans[0].ParentSpanID, "", "no parent for a new trace")
+	test.Is(t, spans[0].Status.Code, spanStatusError, "5xx marks the span failed")
+	test.Is(t, spans[0].Status.Message, "Bad Gateway", "status message")
+}
+
+func TestTracingDisabled(t *testing.T) {
+	a := newTestApp(t, nil)
+	var traceParent, childParent string
+	var injected http.Header
+	a.HandleFunc("/untraced", func(g *Req) error {
+		traceParent = g.ServerSpan().TraceParent()
+		child := g.Span("child")
+		childParent = child.TraceParent()
+		child.End()
+		injected = http.Header{}
+		child.Inject(injected)
+		return g.SendText([]byte("ok"))
+	})
+
+	doRequest(a, "GET", "/untraced", nil, nil)
+	test.Is(t, traceParent, "", "no trace started")
+	test.Is(t, len(injected), 0, "nothing injected")
+
+	inbound := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	doRequest(a, "GET", "/untraced", nil, map[string]string{"traceparent": inbound})
+	test.Is(t, traceParent, inbound, "inbound trace passed through")
+	test.Is(t, childParent, inbound, "inbound trace passed through by child spans")
+	test.Is(t, injected.Get("traceparent"), inbound, "inbound trace injected")
+}
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", true, false},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1", false, false},
+		{"", false, false},
+	}
+	for _, c := range cases {
+		_, _, sampled, ok := parseTraceParent(c.header)
+		test.Is(t, ok, c.ok, c.header+" parsed")
+		test.Is(t, sampled, c.sampled, c.header+" sampled")
+	}
+}
@@ -0,0 +1,38 @@
+package gop
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+func TestAppGauges(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"queue_limit": "10"}})
+	var queued int64 = 3
+	a.RegisterGauge("workers", func() int64 { return 2 })
+	a.RegisterLimit("queue", func() int64 { return atomic.LoadInt64(&queued) }, "queue_limit")
+
+	// Catch the graceful restart's SIGUSR2 rather than restarting the test binary
+	restarts := make(chan os.Signal, 1)
+	signal.Notify(restarts, syscall.SIGUSR2)
+	defer signal.Stop(restarts)
+
+	test.Is(t, a.checkAppGauges(), ",workers=2,queue=3", "TICK info")
+	test.OK(t, hasStat(a, "workers:2|g"), "gauge sent")
+	test.OK(t, hasStat(a, "queue:3|g"), "limited gauge sent")
+	test.Is(t, a.doingGraceful, false, "under the limit")
+
+	atomic.StoreInt64(&queued, 10)
+	test.Is(t, a.checkAppGauges(), ",workers=2,queue=10", "TICK info at the limit")
+	select {
+	case <-restarts:
+	case <-time.After(time.Second):
+		t.Fatal("no graceful restart at the limit")
+	}
+	test.Is(t, a.doingGraceful, true, "graceful restart started")
+}
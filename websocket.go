@@ -0,0 +1,574 @@
+package gop
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSockets (RFC 6455) as ordinary gop routes: the handshake goes through the usual
+// middleware, auth, rate limiting and logging, then the handler gets the connection.
+// The server pings every ws_ping_interval and drops clients that go quiet for
+// ws_pong_timeout, whether or not the handler is reading. Messages over
+// ws_max_message_bytes (never more than 64MB) close the connection. WebSocket
+// routes don't count towards concurrency limits or get [gop] request_timeout, and on
+// graceful restart the old process sends each client a "going away" close so it can
+// reconnect to the new one.
+
+// Message types
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Close codes
+const (
+	CloseNormalClosure       = 1000
+	CloseGoingAway           = 1001
+	CloseProtocolError       = 1002
+	CloseUnsupportedData     = 1003
+	CloseNoStatusReceived    = 1005
+	CloseInvalidPayload      = 1007
+	ClosePolicyViolation     = 1008
+	CloseMessageTooBig       = 1009
+	CloseInternalServerError = 1011
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Messages read but not yet taken by ReadMessage. A client that gets further ahead of
+// the handler than this, or than ws_max_message_bytes of them, is closed with 1008.
+const webSocketReadQueueLen = 16
+
+// The limit on a message, whatever ws_max_message_bytes says
+const maxWebSocketMessageBytes = 64 * 1024 * 1024
+
+var ErrWebSocketClosed = errors.New("websocket closed")
+
+// Returned by reads once the connection is closing. Code is the client's close code,
+// or ours if we closed it.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed [%d] %s", e.Code, e.Text)
+}
+
+// The handler for a WebSocket route. Return nil to close normally; an error is
+// logged and the client gets an internal error close.
+type WebSocketHandlerFunc func(g *Req, conn *WSConn) error
+
+type WSConn struct {
+	g               *Req
+	conn            net.Conn
+	reader          *bufio.Reader
+	maxMessageBytes int64
+	pongTimeout     time.Duration
+	writeTimeout    time.Duration
+	writeLock       sync.Mutex
+	closeSent       bool
+	closeOnce       sync.Once
+	done            chan struct{}
+	messages        chan wsMessage
+	queuedBytes     atomic.Int64 // of the messages waiting in messages
+	readErr         error        // why messages was closed
+}
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+}
+
+func (a *App) HandleWebSocket(u string, h WebSocketHandlerFunc) *Route {
+	route := &Route{longLived: true}
+	route.Route = a.GorillaRouter.HandleFunc(u, a.wrapHandler(a.webSocketHandler(h), route, nil))
+	return route
+}
+
+func (r *Router) HandleWebSocket(u string, h WebSocketHandlerFunc) *Route {
+	handler := r.app.webSocketHandler(h)
+	routed := func(g *Req) error {
+		return WithMiddleware(handler, r.allMiddleware()...)(g)
+	}
+	route := &Route{longLived: true}
+	route.Route = r.GorillaRouter.HandleFunc(u, r.app.wrapHandler(routed, route, nil))
+	return route
+}
+
+func (a *App) webSocketHandler(h WebSocketHandlerFunc) HandlerFunc {
+	return func(g *Req) error {
+		g.kind.Store("websocket")
+		g.CanBeSlow = true
+		maxConns := a.configInt("gop", "ws_max_connections", 0)
+		if maxConns > 0 && a.webSocketCount() >= maxConns {
+			a.Stats.Inc("websocket.refused", 1)
+			return HTTPError{Code: http.StatusServiceUnavailable, Body: "Too many websocket connections", ErrorCode: "overloaded"}
+		}
+		conn, err := g.upgradeWebSocket()
+		if err != nil {
+			return err
+		}
+		a.addWebSocket(conn)
+		defer a.removeWebSocket(conn)
+		go conn.pinger()
+		go conn.readLoop()
+
+		err = h(g, conn)
+		var closeErr *CloseError
+		switch {
+		case err == nil:
+			conn.Close(CloseNormalClosure, "")
+		case errors.As(err, &closeErr) || errors.Is(err, ErrWebSocketClosed) || errors.Is(err, io.EOF):
+			// The client went away, or we already closed
+			conn.Close(CloseNormalClosure, "")
+		default:
+			g.Errorf("WebSocket handler failed: %s", err.Error())
+			conn.Close(CloseInternalServerError, "internal error")
+		}
+		// The response has gone - don't let the wrapper send an error
+		return nil
+	}
+}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h[key] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *App) webSocketOriginAllowed(r *http.Request) bool {
+	allowed, _ := a.Cfg.GetList("gop", "ws_allowed_origins", nil)
+	if len(allowed) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the handshake, take the connection off the http.Server and answer with 101
+func (g *Req) upgradeWebSocket() (*WSConn, error) {
+	r := g.R
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, HTTPError{Code: http.StatusUpgradeRequired, Body: "WebSocket upgrade required", ErrorCode: "websocket_required"}.WithHeader("Upgrade", "websocket")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, HTTPError{Code: http.StatusUpgradeRequired, Body: "Unsupported WebSocket version", ErrorCode: "websocket_version"}.WithHeader("Sec-WebSocket-Version", "13")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decodedKey) != 16 {
+		return nil, HTTPError{Code: http.StatusBadRequest, Body: "Bad Sec-WebSocket-Key", ErrorCode: "websocket_key"}
+	}
+	if !g.app.webSocketOriginAllowed(r) {
+		g.app.Stats.Inc("websocket.bad_origin", 1)
+		return nil, HTTPError{Code: http.StatusForbidden, Body: "Origin not allowed", ErrorCode: "forbidden"}
+	}
+	if _, buffered := g.W.ResponseWriter.(*timeoutWriter); buffered {
+		g.Errorf("WebSocket route %s has a timeout - it needs none", g.routeName)
+		return nil, HTTPError{Code: http.StatusInternalServerError, Body: "WebSocket route has a timeout"}
+	}
+	hijacker, ok := g.W.ResponseWriter.(http.Hijacker)
+	if !ok {
+		// e.g. HTTP/2, which we don't do websockets over
+		return nil, HTTPError{Code: http.StatusBadRequest, Body: "WebSocket needs HTTP/1.1", ErrorCode: "websocket_required"}
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	g.W.lock.Lock()
+	defer g.W.lock.Unlock()
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Nothing more goes through the ResponseWriter
+	g.W.compress = nil
+	g.W.code = http.StatusSwitchingProtocols
+	g.W.headerSent = true
+	// Clear any deadlines the http.Server set
+	netConn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n"
+	if g.requestID != "" {
+		response += g.app.requestIDHeader() + ": " + g.requestID + "\r\n"
+	}
+	_, err = netConn.Write([]byte(response + "\r\n"))
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	cfg := g.app.Cfg
+	maxBytes := g.app.configInt64("gop", "ws_max_message_bytes", 1024*1024)
+	if maxBytes <= 0 || maxBytes > maxWebSocketMessageBytes {
+		maxBytes = maxWebSocketMessageBytes
+	}
+	pongTimeout, _ := cfg.GetDuration("gop", "ws_pong_timeout", 60*time.Second)
+	writeTimeout, _ := cfg.GetDuration("gop", "ws_write_timeout", 10*time.Second)
+	return &WSConn{
+		g:               g,
+		conn:            netConn,
+		reader:          rw.Reader,
+		maxMessageBytes: maxBytes,
+		pongTimeout:     pongTimeout,
+		writeTimeout:    writeTimeout,
+		done:            make(chan struct{}),
+		messages:        make(chan wsMessage, webSocketReadQueueLen),
+	}, nil
+}
+
+func (a *App) addWebSocket(c *WSConn) {
+	a.webSocketsLock.Lock()
+	if a.webSockets == nil {
+		a.webSockets = make(map[*WSConn]bool)
+	}
+	a.webSockets[c] = true
+	count := len(a.webSockets)
+	a.webSocketsLock.Unlock()
+	a.Stats.Inc("websocket.opened", 1)
+	a.Stats.Gauge("websocket.connections", int64(count))
+}
+
+func (a *App) removeWebSocket(c *WSConn) {
+	a.webSocketsLock.Lock()
+	delete(a.webSockets, c)
+	count := len(a.webSockets)
+	a.webSocketsLock.Unlock()
+	a.Stats.Inc("websocket.closed", 1)
+	a.Stats.Gauge("websocket.connections", int64(count))
+}
+
+func (a *App) webSocketCount() int {
+	a.webSocketsLock.Lock()
+	defer a.webSocketsLock.Unlock()
+	return len(a.webSockets)
+}
+
+// Ask every client to go away, e.g. on graceful restart. Handlers see a CloseError on
+// their next read; connections whose handlers don't read are dropped after
+// ws_close_timeout.
+func (a *App) closeWebSockets(code int, reason string) {
+	grace, _ := a.Cfg.GetDuration("gop", "ws_close_timeout", 5*time.Second)
+	a.webSocketsLock.Lock()
+	conns := make([]*WSConn, 0, len(a.webSockets))
+	for c := range a.webSockets {
+		conns = append(conns, c)
+	}
+	a.webSocketsLock.Unlock()
+	if len(conns) > 0 {
+		a.Info("Closing %d websockets: %s", len(conns), reason)
+	}
+	for _, c := range conns {
+		c.sendClose(code, reason)
+		time.AfterFunc(grace, c.shutdown)
+	}
+}
+
+func (c *WSConn) pinger() {
+	interval, _ := c.g.app.Cfg.GetDuration("gop", "ws_ping_interval", 30*time.Second)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.writeFrame(PingMessage, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *WSConn) writeFrame(opcode int, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closeSent {
+		return ErrWebSocketClosed
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|byte(opcode))
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+type wsProtocolError struct {
+	code int
+	text string
+}
+
+func (e *wsProtocolError) Error() string {
+	return e.text
+}
+
+func (c *WSConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.reader, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = int(head[0] & 0x0f)
+	if head[0]&0x70 != 0 {
+		return fin, opcode, nil, &wsProtocolError{CloseProtocolError, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return fin, opcode, nil, &wsProtocolError{CloseProtocolError, "unmasked client frame"}
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= CloseMessage && (length > 125 || !fin) {
+		return fin, opcode, nil, &wsProtocolError{CloseProtocolError, "bad control frame"}
+	}
+	if length > uint64(c.maxMessageBytes) {
+		return fin, opcode, nil, &wsProtocolError{CloseMessageTooBig, "message too big"}
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Fail the connection with the close code the problem calls for
+func (c *WSConn) readFailed(code int, text string) error {
+	c.g.app.Stats.Inc("websocket.protocol_errors", 1)
+	c.Close(code, text)
+	return &CloseError{Code: code, Text: text}
+}
+
+// Read for as long as the connection lasts, so that pings are answered and a client
+// that goes quiet is dropped even while the handler is only writing. Messages queue
+// for ReadMessage; we never wait for it, so a client which sends more than the handler
+// takes fills the queue and is closed.
+func (c *WSConn) readLoop() {
+	defer close(c.messages)
+	for {
+		messageType, data, err := c.readMessage()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		queued := c.queuedBytes.Add(int64(len(data)))
+		overLimit := queued > c.maxMessageBytes && queued > int64(len(data))
+		if len(c.messages) == cap(c.messages) || overLimit {
+			c.g.app.Stats.Inc("websocket.read_queue_full", 1)
+			c.Close(ClosePolicyViolation, "too many unread messages")
+			c.readErr = &CloseError{Code: ClosePolicyViolation, Text: "too many unread messages"}
+			return
+		}
+		// Only we send, so there's room
+		c.messages <- wsMessage{messageType, data}
+	}
+}
+
+// The next text or binary message. A close from the client is answered and returned
+// as a *CloseError.
+func (c *WSConn) ReadMessage() (messageType int, data []byte, err error) {
+	m, ok := <-c.messages
+	if !ok {
+		return 0, nil, c.readErr
+	}
+	c.queuedBytes.Add(-int64(len(m.data)))
+	return m.messageType, m.data, nil
+}
+
+// Closed once the connection has gone, e.g. for handlers which only write
+func (c *WSConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *WSConn) readMessage() (messageType int, data []byte, err error) {
+	for {
+		if c.pongTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.pongTimeout))
+		}
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			var protoErr *wsProtocolError
+			if errors.As(err, &protoErr) {
+				return 0, nil, c.readFailed(protoErr.code, protoErr.text)
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.g.app.Stats.Inc("websocket.pong_timeouts", 1)
+			}
+			c.shutdown()
+			return 0, nil, err
+		}
+		switch opcode {
+		case PingMessage:
+			c.writeFrame(PongMessage, payload)
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			closeErr := &CloseError{Code: CloseNoStatusReceived}
+			if len(payload) == 1 {
+				return 0, nil, c.readFailed(CloseProtocolError, "bad close frame")
+			}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Text = string(payload[2:])
+			}
+			// Echo it, unless this is the answer to ours. 1005 mustn't be sent, so an
+			// empty close gets an empty close back.
+			if len(payload) == 0 {
+				c.writeFrame(CloseMessage, nil)
+			} else {
+				c.sendClose(closeErr.Code, "")
+			}
+			c.shutdown()
+			return 0, nil, closeErr
+		case 0:
+			if messageType == 0 {
+				return 0, nil, c.readFailed(CloseProtocolError, "unexpected continuation frame")
+			}
+			data = append(data, payload...)
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.readFailed(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = opcode
+			data = payload
+		default:
+			return 0, nil, c.readFailed(CloseProtocolError, "unknown opcode")
+		}
+		if int64(len(data)) > c.maxMessageBytes {
+			return 0, nil, c.readFailed(CloseMessageTooBig, "message too big")
+		}
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(data) {
+				return 0, nil, c.readFailed(CloseInvalidPayload, "invalid utf-8")
+			}
+			c.g.app.Stats.Inc("websocket.messages_in", 1)
+			return messageType, data, nil
+		}
+	}
+}
+
+func (c *WSConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("can't send websocket message type %d", messageType)
+	}
+	err := c.writeFrame(messageType, data)
+	if err == nil {
+		c.g.app.Stats.Inc("websocket.messages_out", 1)
+	}
+	return err
+}
+
+// Read a text message into v
+func (c *WSConn) ReadJSON(v interface{}) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *WSConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(TextMessage, data)
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Send a close frame (once) without dropping the connection, so the client can answer
+func (c *WSConn) sendClose(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.writeFrame(CloseMessage, append(payload, reason...))
+}
+
+func (c *WSConn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// Send a close frame, if we haven't already, and drop the connection
+func (c *WSConn) Close(code int, reason string) error {
+	c.sendClose(code, reason)
+	c.shutdown()
+	return nil
+}
@@ -0,0 +1,303 @@
+package gop
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/trendmicro/gop/test"
+)
+
+// A client speaking raw frames, to check what goes over the wire
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, addr, path string) (*wsTestClient, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	c := &wsTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+func (c *wsTestClient) sendHeader(opcode int, fin bool, length int) {
+	head := []byte{byte(opcode), 0x80}
+	if fin {
+		head[0] |= 0x80
+	}
+	switch {
+	case length < 126:
+		head[1] |= byte(length)
+	case length <= 0xffff:
+		head[1] |= 126
+		head = binary.BigEndian.AppendUint16(head, uint16(length))
+	default:
+		head[1] |= 127
+		head = binary.BigEndian.AppendUint64(head, uint64(length))
+	}
+	c.conn.Write(append(head, 1, 2, 3, 4))
+}
+
+func (c *wsTestClient) send(opcode int, fin bool, payload []byte) {
+	c.sendHeader(opcode, fin, len(payload))
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ byte(i%4+1)
+	}
+	c.conn.Write(masked)
+}
+
+// The next frame from the server, or -1 if it has gone
+func (c *wsTestClient) read() (int, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var head [2]byte
+	if _, err := c.r.Read(head[:1]); err != nil {
+		return -1, nil
+	}
+	if _, err := c.r.Read(head[1:]); err != nil {
+		return -1, nil
+	}
+	test.OK(c.t, head[1]&0x80 == 0, "server frames aren't masked")
+	length := int(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		c.r.Read(ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		c.r.Read(ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	for n := 0; n < length; {
+		m, err := c.r.Read(payload[n:])
+		if err != nil {
+			return -1, nil
+		}
+		n += m
+	}
+	return int(head[0] & 0x0f), payload
+}
+
+// The next frame that isn't a ping
+func (c *wsTestClient) readSkippingPings() (int, []byte) {
+	for {
+		opcode, payload := c.read()
+		if opcode != PingMessage {
+			return opcode, payload
+		}
+	}
+}
+
+func closeCode(payload []byte) int {
+	if len(payload) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func newEchoApp(t *testing.T, cfg map[string]string) (*App, string) {
+	a := newTestApp(t, ConfigMap{"gop": cfg})
+	a.HandleWebSocket("/echo", func(g *Req, conn *WSConn) error {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return err
+			}
+		}
+	})
+	return a, serveTestApp(t, a)
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	_, addr := newEchoApp(t, map[string]string{"request_id_header": "X-Correlation-Id"})
+	c, resp := dialWebSocket(t, addr, "/echo")
+	test.Is(t, resp.StatusCode, http.StatusSwitchingProtocols, "status")
+	test.Is(t, resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", "accept key")
+	test.Is(t, len(resp.Header.Get("X-Correlation-Id")), 32, "request id in the configured header")
+	test.Is(t, resp.Header.Get("X-Request-Id"), "", "no default request id header")
+
+	c.send(TextMessage, true, []byte("hello"))
+	opcode, payload := c.read()
+	test.Is(t, opcode, TextMessage, "echo type")
+	test.Is(t, string(payload), "hello", "echo")
+
+	httpResp, err := http.Get("http://" + addr + "/echo")
+	test.ErrIs(t, err, nil, "plain GET")
+	httpResp.Body.Close()
+	test.Is(t, httpResp.StatusCode, http.StatusUpgradeRequired, "plain GET status")
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	_, addr := newEchoApp(t, nil)
+	c, _ := dialWebSocket(t, addr, "/echo")
+
+	c.send(BinaryMessage, false, []byte("frag"))
+	c.send(PingMessage, true, []byte("ping in between"))
+	c.send(0, true, []byte("mented"))
+	opcode, payload := c.read()
+	test.Is(t, opcode, PongMessage, "ping answered")
+	test.Is(t, string(payload), "ping in between", "pong payload")
+	opcode, payload = c.read()
+	test.Is(t, opcode, BinaryMessage, "reassembled type")
+	test.Is(t, string(payload), "fragmented", "reassembled message")
+
+	c.send(TextMessage, true, []byte{0xff, 0xfe})
+	opcode, payload = c.read()
+	test.Is(t, opcode, CloseMessage, "invalid utf-8 closes")
+	test.Is(t, closeCode(payload), CloseInvalidPayload, "invalid utf-8 close code")
+}
+
+func TestWebSocketCloseHandshake(t *testing.T) {
+	_, addr := newEchoApp(t, nil)
+
+	c, _ := dialWebSocket(t, addr, "/echo")
+	c.send(CloseMessage, true, binary.BigEndian.AppendUint16(nil, CloseGoingAway))
+	opcode, payload := c.read()
+	test.Is(t, opcode, CloseMessage, "close echoed")
+	test.Is(t, closeCode(payload), CloseGoingAway, "close code echoed")
+	opcode, _ = c.read()
+	test.Is(t, opcode, -1, "connection dropped after close")
+
+	c, _ = dialWebSocket(t, addr, "/echo")
+	c.send(CloseMessage, true, nil)
+	opcode, payload = c.read()
+	test.Is(t, opcode, CloseMessage, "empty close echoed")
+	test.Is(t, len(payload), 0, "empty close echoed empty, not as 1005")
+
+	c, _ = dialWebSocket(t, addr, "/echo")
+	c.send(CloseMessage, true, []byte{3})
+	opcode, payload = c.read()
+	test.Is(t, opcode, CloseMessage, "one byte close answered")
+	test.Is(t, closeCode(payload), CloseProtocolError, "one byte close is a protocol error")
+}
+
+func TestWebSocketMessageLimits(t *testing.T) {
+	_, addr := newEchoApp(t, map[string]string{"ws_max_message_bytes": "10"})
+	c, _ := dialWebSocket(t, addr, "/echo")
+	c.send(TextMessage, true, []byte("0123456789"))
+	_, payload := c.read()
+	test.Is(t, string(payload), "0123456789", "message at the limit")
+	c.send(TextMessage, true, []byte("0123456789a"))
+	opcode, payload := c.read()
+	test.Is(t, opcode, CloseMessage, "message over the limit closes")
+	test.Is(t, closeCode(payload), CloseMessageTooBig, "too big close code")
+
+	c, _ = dialWebSocket(t, addr, "/echo")
+	c.send(TextMessage, false, []byte("012345"))
+	c.send(0, true, []byte("6789a"))
+	opcode, payload = c.read()
+	test.Is(t, closeCode(payload), CloseMessageTooBig, "fragmented message over the limit closes")
+
+	// Unlimited still has a cap, checked before anything is allocated
+	_, addr = newEchoApp(t, map[string]string{"ws_max_message_bytes": "0"})
+	c, _ = dialWebSocket(t, addr, "/echo")
+	c.sendHeader(BinaryMessage, true, 1<<40)
+	opcode, payload = c.read()
+	test.Is(t, opcode, CloseMessage, "huge frame closes")
+	test.Is(t, closeCode(payload), CloseMessageTooBig, "huge frame close code")
+}
+
+func TestWebSocketPongTimeout(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {
+		"ws_ping_interval": "50ms",
+		"ws_pong_timeout":  "300ms",
+	}})
+	gone := make(chan bool, 1)
+	a.HandleWebSocket("/push", func(g *Req, conn *WSConn) error {
+		// Never reads
+		conn.WriteMessage(TextMessage, []byte("hello"))
+		select {
+		case <-conn.Done():
+			gone <- true
+		case <-time.After(time.Second):
+			gone <- false
+		}
+		return nil
+	})
+	addr := serveTestApp(t, a)
+
+	// A client that answers pings outlives the timeout
+	c, _ := dialWebSocket(t, addr, "/push")
+	var opcode int
+	var payload []byte
+	for {
+		opcode, payload = c.read()
+		if opcode != PingMessage && opcode != TextMessage {
+			break
+		}
+		if opcode == PingMessage {
+			c.send(PongMessage, true, payload)
+		}
+	}
+	test.Is(t, <-gone, false, "live client kept")
+	test.Is(t, opcode, CloseMessage, "handler return closes")
+	test.Is(t, closeCode(payload), CloseNormalClosure, "normal close")
+
+	// One that doesn't is dropped, though the handler isn't reading
+	dialWebSocket(t, addr, "/push")
+	test.Is(t, <-gone, true, "quiet client dropped")
+	test.OK(t, hasStat(a, "websocket.pong_timeouts:"), "timeout counted")
+}
+
+func TestWebSocketReadQueue(t *testing.T) {
+	a := newTestApp(t, ConfigMap{"gop": {"ws_ping_interval": "0"}})
+	a.HandleWebSocket("/push", func(g *Req, conn *WSConn) error {
+		// Never reads
+		<-conn.Done()
+		return nil
+	})
+	addr := serveTestApp(t, a)
+
+	// Pings are answered even with messages waiting for the handler
+	c, _ := dialWebSocket(t, addr, "/push")
+	c.send(TextMessage, true, []byte("unread"))
+	c.send(PingMessage, true, []byte("still there?"))
+	opcode, payload := c.read()
+	test.Is(t, opcode, PongMessage, "ping answered")
+	test.Is(t, string(payload), "still there?", "pong payload")
+
+	// Until the queue is full
+	for i := 1; i <= webSocketReadQueueLen; i++ {
+		c.send(TextMessage, true, []byte("unread"))
+	}
+	opcode, payload = c.read()
+	test.Is(t, opcode, CloseMessage, "closed once the queue is full")
+	test.Is(t, closeCode(payload), ClosePolicyViolation, "policy violation")
+	test.OK(t, hasStat(a, "websocket.read_queue_full:1|c"), "counted")
+}
+
+func TestWebSocketGoingAway(t *testing.T) {
+	a, addr := newEchoApp(t, map[string]string{"ws_max_connections": "1"})
+	c, _ := dialWebSocket(t, addr, "/echo")
+	_, resp := dialWebSocket(t, addr, "/echo")
+	test.Is(t, resp.StatusCode, http.StatusServiceUnavailable, "over ws_max_connections")
+
+	a.closeWebSockets(CloseGoingAway, "restarting")
+	opcode, payload := c.readSkippingPings()
+	test.Is(t, opcode, CloseMessage, "going away sent")
+	test.Is(t, closeCode(payload), CloseGoingAway, "going away code")
+	test.Is(t, string(payload[2:]), "restarting", "going away reason")
+}